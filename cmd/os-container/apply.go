@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	oc "github.com/giuseppe/os-containers/pkg/os-containers"
+	"github.com/urfave/cli"
+)
+
+func getApplyCommand() cli.Command {
+	return cli.Command{
+		Name:  "apply",
+		Usage: "converge the installed containers to the specified configuration",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "file, f",
+				Usage: "YAML file with the list of containers",
+			},
+			cli.BoolFlag{
+				Name:  "prune",
+				Usage: "uninstall the containers that are not listed in the file",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only show the changes without applying them",
+			},
+			cli.BoolFlag{
+				Name:  "yes, y",
+				Usage: "accept the privileges of the containers without asking",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return applyContainers(c)
+		},
+	}
+}
+
+func printAppliedChanges(changes []oc.AppliedChange) {
+	fmtString := "%-20s %-10s %s\n"
+	fmt.Printf(fmtString, "NAME", "ACTION", "REASON")
+	for _, c := range changes {
+		fmt.Printf(fmtString, c.Name, c.Action, strings.Join(c.Reasons, ","))
+	}
+}
+
+func applyContainers(c *cli.Context) error {
+	file := c.String("file")
+	if file == "" {
+		return fmt.Errorf("a file must be specified with --file")
+	}
+	state, err := oc.ReadDesiredState(file)
+	if err != nil {
+		return err
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	changes, err := m.Apply(state, c.Bool("prune"), c.Bool("dry-run"), confirmPrivileges(c))
+	printAppliedChanges(changes)
+	return err
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	oc "github.com/giuseppe/os-containers/pkg/os-containers"
@@ -23,7 +25,175 @@ func getContainersCommand() cli.Command {
 					},
 				},
 				Action: func(c *cli.Context) error {
-					return listContainers(c.Bool("all"))
+					return listContainers(c)
+				},
+			},
+			{
+				Name:  "outdated",
+				Usage: "show containers with pending updates",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "all",
+						Usage: "show also containers that are up to date",
+					},
+					cli.BoolFlag{
+						Name:  "remote",
+						Usage: "check the registry for newer images",
+					},
+					cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "allow to query an insecure registry",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return listOutdatedContainers(c)
+				},
+			},
+			{
+				Name:      "start",
+				Usage:     "start containers",
+				ArgsUsage: "NAME...",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "wait",
+						Usage: "wait until the containers are active",
+					},
+					cli.IntFlag{
+						Name:  "timeout",
+						Usage: "seconds to wait for the containers with --wait",
+						Value: 60,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return serviceContainers(c, (*oc.Manager).Start)
+				},
+			},
+			{
+				Name:      "stop",
+				Usage:     "stop containers",
+				ArgsUsage: "NAME...",
+				Action: func(c *cli.Context) error {
+					return serviceContainers(c, (*oc.Manager).Stop)
+				},
+			},
+			{
+				Name:      "restart",
+				Usage:     "restart containers",
+				ArgsUsage: "NAME...",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "wait",
+						Usage: "wait until the containers are active",
+					},
+					cli.IntFlag{
+						Name:  "timeout",
+						Usage: "seconds to wait for the containers with --wait",
+						Value: 60,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return serviceContainers(c, (*oc.Manager).Restart)
+				},
+			},
+			{
+				Name:      "status",
+				Usage:     "show the status of containers",
+				ArgsUsage: "NAME...",
+				Action: func(c *cli.Context) error {
+					return showContainersStatus(c)
+				},
+			},
+			{
+				Name:      "cleanup",
+				Usage:     "delete the runtime state left by a stopped container",
+				ArgsUsage: "NAME",
+				Action: func(c *cli.Context) error {
+					return cleanupContainer(c)
+				},
+			},
+			{
+				Name:      "logs",
+				Usage:     "show the logs of a container",
+				ArgsUsage: "NAME",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "follow, f",
+						Usage: "keep showing new entries",
+					},
+					cli.StringFlag{
+						Name:  "since",
+						Usage: "show entries not older than the specified date",
+					},
+					cli.IntFlag{
+						Name:  "lines, n",
+						Usage: "show the specified number of most recent entries",
+					},
+					cli.StringFlag{
+						Name:  "output, o",
+						Usage: "specify the format, either \"short\" or \"json\"",
+						Value: "short",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return showContainerLogs(c)
+				},
+			},
+			{
+				Name:      "volumes",
+				Usage:     "list the volumes of a container",
+				ArgsUsage: "NAME",
+				Action: func(c *cli.Context) error {
+					return listContainerVolumes(c)
+				},
+			},
+			{
+				Name:  "secret",
+				Usage: "manage the secrets of a container",
+				Subcommands: []cli.Command{
+					{
+						Name:      "update",
+						Usage:     "replace the secrets of a container without a new deployment",
+						ArgsUsage: "NAME SECRET=FILE...",
+						Action: func(c *cli.Context) error {
+							return updateContainerSecrets(c)
+						},
+					},
+				},
+			},
+			{
+				Name:      "export",
+				Usage:     "export a container with its configuration and data",
+				ArgsUsage: "NAME",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "output, o",
+						Usage: "write the archive to the specified file",
+					},
+					cli.BoolFlag{
+						Name:  "image",
+						Usage: "include the image in the archive",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return exportContainer(c)
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "install a container from an archive created with export",
+				ArgsUsage: "FILE",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "name",
+						Usage: "specify a different name for the container",
+					},
+					cli.BoolFlag{
+						Name:  "yes, y",
+						Usage: "accept the privileges of the container without asking",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return importContainer(c)
 				},
 			},
 		},
@@ -38,25 +208,256 @@ func getCreated(c int64) string {
 		t.Hour(), t.Minute(), t.Second())
 }
 
-func listContainers(all bool) error {
-	containers, err := oc.GetContainers(all)
+func listContainers(c *cli.Context) error {
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	all := c.Bool("all")
+	containers, err := m.List()
 	if err != nil {
 		return err
 	}
 	fmtString := "%-10s %-40s %-20s %-10s %-15s\n"
 	fmt.Printf(fmtString, "NAME", "IMAGE", "CREATED", "STATE", "RUNTIME")
-	for _, c := range containers {
-		status, err := c.ContainerStatus()
+	var warnings []string
+	for _, ctr := range containers {
+		state, err := m.ContainerState(&ctr)
 		if err != nil {
 			return err
 		}
-		if !all && status != oc.Running {
+		if !all && state.Unit != oc.Running && state.Mismatch == "" {
+			continue
+		}
+
+		statusString := oc.GetContainerStatusString(state.Unit)
+		if state.Mismatch != "" {
+			statusString = statusString + "!"
+			warnings = append(warnings, fmt.Sprintf("%s: %s", ctr.Name, state.Mismatch))
+		}
+		if state.RuntimeError != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", ctr.Name, state.RuntimeError))
+		}
+		fmt.Printf(fmtString, ctr.Name, ctr.Image, getCreated(ctr.Created), statusString, ctr.Runtime)
+
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+	return nil
+}
+
+func listOutdatedContainers(c *cli.Context) error {
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	all := c.Bool("all")
+	containers, err := m.Outdated(c.Bool("remote"), c.Bool("insecure"))
+	if err != nil {
+		return err
+	}
+	fmtString := "%-10s %-40s %-14s %-14s %-14s %-10s\n"
+	fmt.Printf(fmtString, "NAME", "IMAGE", "REVISION", "LOCAL", "REMOTE", "UPDATE")
+	for _, o := range containers {
+		update := "none"
+		if o.HasLocalUpdate() {
+			update = "local"
+		} else if o.HasRemoteUpdate() {
+			update = "remote"
+		}
+		if !all && update == "none" {
 			continue
 		}
 
-		statusString := oc.GetContainerStatusString(status)
-		fmt.Printf(fmtString, c.Name, c.Image, getCreated(c.Created), statusString, c.Runtime)
+		local := truncateString(o.LocalRevision, 12)
+		if local == "" {
+			local = "<none>"
+		}
+		remoteRevision := truncateString(o.RemoteRevision, 12)
+		if remoteRevision == "" {
+			remoteRevision = "-"
+		}
+		fmt.Printf(fmtString, o.Name, o.Image, truncateString(o.Revision, 12), local, remoteRevision, update)
+	}
+	return nil
+}
+
+func exportContainer(c *cli.Context) error {
+	name := c.Args().First()
+	output := c.String("output")
+	if name == "" || output == "" {
+		return fmt.Errorf("a container name and the --output file must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.Export(name, output, c.Bool("image"))
+}
+
+func importContainer(c *cli.Context) error {
+	input := c.Args().First()
+	if input == "" {
+		return fmt.Errorf("an archive must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.Import(input, c.String("name"), c.GlobalString("runtime"), confirmPrivileges(c))
+}
+
+func showContainerLogs(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return fmt.Errorf("a container name must be specified")
+	}
+	output := c.String("output")
+	if output != "short" && output != "json" {
+		return fmt.Errorf("invalid output format %s", output)
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.Logs(name, oc.LogsOptions{
+		Follow: c.Bool("follow"),
+		Since:  c.String("since"),
+		Lines:  c.Int("lines"),
+		JSON:   output == "json",
+	})
+}
 
+func serviceContainers(c *cli.Context, action func(*oc.Manager, string) error) error {
+	names := c.Args()
+	if len(names) == 0 {
+		return fmt.Errorf("at least a container name must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, name := range names {
+		err := action(m, name)
+		if err == nil && c.Bool("wait") {
+			err = m.WaitActive(name, time.Duration(c.Int("timeout"))*time.Second)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed containers: %s", strings.Join(failed, ", "))
 	}
 	return nil
 }
+
+func showContainersStatus(c *cli.Context) error {
+	names := c.Args()
+	if len(names) == 0 {
+		return fmt.Errorf("at least a container name must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	fmtString := "%-10s %-40s %-10s %-8s %-10s %s\n"
+	fmt.Printf(fmtString, "NAME", "IMAGE", "STATE", "PID", "RUNTIME", "BUNDLE")
+	for _, name := range names {
+		ctr, err := m.GetContainer(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		state, err := m.ContainerState(ctr)
+		if err != nil {
+			return err
+		}
+		statusString := "-"
+		if ctr.HasContainerService {
+			statusString = oc.GetContainerStatusString(state.Unit)
+		}
+		pid, runtimeStatus, bundle := "-", "-", "-"
+		if state.Runtime != nil {
+			if state.Runtime.Pid > 0 {
+				pid = fmt.Sprintf("%d", state.Runtime.Pid)
+			}
+			runtimeStatus = state.Runtime.Status
+			bundle = state.Runtime.Bundle
+		}
+		fmt.Printf(fmtString, ctr.Name, ctr.Image, statusString, pid, runtimeStatus, bundle)
+		if state.Mismatch != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", ctr.Name, state.Mismatch)
+		}
+		if state.RuntimeError != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", ctr.Name, state.RuntimeError)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed containers: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func cleanupContainer(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return fmt.Errorf("a container name must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.Cleanup(name)
+}
+
+func listContainerVolumes(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return fmt.Errorf("a container name must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	volumes, err := m.Volumes(name)
+	if err != nil {
+		return err
+	}
+	fmtString := "%-15s %-30s %-10s %s\n"
+	fmt.Printf(fmtString, "NAME", "PATH", "SIZE", "SOURCE")
+	for _, v := range volumes {
+		path := v.Path
+		if path == "" {
+			path = "<unused>"
+		}
+		fmt.Printf(fmtString, v.Name, path, humanSize(v.Size), v.Source)
+	}
+	return nil
+}
+
+func updateContainerSecrets(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return fmt.Errorf("a container name must be specified")
+	}
+	secrets, err := parseSecrets(c.Args().Tail())
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return fmt.Errorf("at least a secret must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.UpdateSecrets(name, secrets)
+}
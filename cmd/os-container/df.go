@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	units "github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+func getDfCommand() cli.Command {
+	return cli.Command{
+		Name:  "df",
+		Usage: "show the disk space used by images and containers",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "verbose, v",
+				Usage: "show the space used by each layer",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return showDiskUsage(c)
+		},
+	}
+}
+
+func humanSize(s uint64) string {
+	return units.HumanSize(float64(s))
+}
+
+func showDiskUsage(c *cli.Context) error {
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	usage, err := m.DiskUsage()
+	if err != nil {
+		return err
+	}
+	verbose := c.Bool("verbose")
+
+	fmt.Printf("Repository: %s, reclaimable with images prune: %s\n\n", humanSize(usage.RepoSize), humanSize(usage.Reclaimable))
+
+	fmtString := "%-42s %-14s %-10s %-10s %-10s\n"
+	fmt.Printf(fmtString, "IMAGE", "VERSION", "SIZE", "UNIQUE", "SHARED")
+	for _, i := range usage.Images {
+		fmt.Printf(fmtString, truncateString(i.Name, 40), truncateString(i.ImageID, 12), humanSize(i.Size), humanSize(i.Unique), humanSize(i.Shared))
+		if !verbose {
+			continue
+		}
+		for _, l := range i.Layers {
+			fmt.Printf(fmtString, "  "+truncateString(l.Digest, 38), "", humanSize(l.Size), humanSize(l.Unique), "")
+		}
+	}
+
+	fmt.Println()
+	fmtString = "%-20s %-12s %-8s %-10s %-10s\n"
+	fmt.Printf(fmtString, "CONTAINER", "DEPLOYMENT", "ACTIVE", "SIZE", "EXCLUSIVE")
+	for _, ctr := range usage.Containers {
+		for _, d := range ctr.Deployments {
+			active := "no"
+			if d.Active {
+				active = "yes"
+			}
+			fmt.Printf(fmtString, ctr.Name, fmt.Sprintf("%d", d.Deployment), active, humanSize(d.Size), humanSize(d.Exclusive))
+		}
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	oc "github.com/giuseppe/os-containers/pkg/os-containers"
 	"github.com/urfave/cli"
@@ -26,7 +29,44 @@ func getImagesCommand() cli.Command {
 					},
 				},
 				Action: func(c *cli.Context) error {
-					return listImages(c.Bool("all"), c.Bool("no-truncate"))
+					return listImages(c)
+				},
+			},
+			{
+				Name:      "inspect",
+				Usage:     "show what an image needs before installing it",
+				ArgsUsage: "IMAGE",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "output, o",
+						Usage: "specify the format, either \"table\" or \"json\"",
+						Value: "table",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return inspectImage(c)
+				},
+			},
+			{
+				Name:      "save",
+				Usage:     "save images to an archive",
+				ArgsUsage: "IMAGE...",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "output, o",
+						Usage: "write the archive to the specified file",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return saveImages(c)
+				},
+			},
+			{
+				Name:      "load",
+				Usage:     "load the images from an archive created with save",
+				ArgsUsage: "FILE",
+				Action: func(c *cli.Context) error {
+					return loadImages(c)
 				},
 			},
 			{
@@ -47,7 +87,7 @@ func getImagesCommand() cli.Command {
 				Name:  "prune",
 				Usage: "prune unused images",
 				Action: func(c *cli.Context) error {
-					return pruneImages()
+					return pruneImages(c)
 				},
 			},
 		},
@@ -61,16 +101,21 @@ func truncateString(s string, l int) string {
 	return s
 }
 
-func listImages(all bool, noTruncate bool) error {
-	images, err := oc.GetImages(all)
+func listImages(c *cli.Context) error {
+	m, err := newManager(c)
 	if err != nil {
 		return err
 	}
-	fmtString := "%-42 s%-14s %-20s\n"
+	noTruncate := c.Bool("no-truncate")
+	images, err := m.Images(c.Bool("all"))
+	if err != nil {
+		return err
+	}
+	fmtString := "%-42 s%-14s %-20s %s\n"
 	if noTruncate {
-		fmtString = "%-42s %-65s %-20s\n"
+		fmtString = "%-42s %-65s %-20s %s\n"
 	}
-	fmt.Printf(fmtString, "NAME", "VERSION", "SIZE")
+	fmt.Printf(fmtString, "NAME", "VERSION", "SIZE", "PLATFORM")
 	for _, i := range images {
 		name := i.Name
 		id := i.ImageID
@@ -81,23 +126,148 @@ func listImages(all bool, noTruncate bool) error {
 		if name == "" {
 			name = "<none>"
 		}
-		fmt.Printf(fmtString, name, id, fmt.Sprintf("%d", i.Size))
+		platform := i.Platform
+		if platform == "" {
+			platform = "-"
+		}
+		fmt.Printf(fmtString, name, id, fmt.Sprintf("%d", i.Size), platform)
 
 	}
 	return nil
 }
 
 func deleteImage(c *cli.Context) error {
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
 	image := c.Args().First()
-	return oc.DeleteImage(image)
+	return m.DeleteImage(image)
 }
 
-func pruneImages() error {
-	return oc.PruneImages()
+func pruneImages(c *cli.Context) error {
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.PruneImages()
 }
 
 func tagImage(c *cli.Context) error {
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
 	src := c.Args().Get(0)
 	dest := c.Args().Get(1)
-	return oc.TagImage(src, dest)
+	return m.TagImage(src, dest)
+}
+
+func inspectImage(c *cli.Context) error {
+	image := c.Args().First()
+	if image == "" {
+		return fmt.Errorf("an image must be specified")
+	}
+	output := c.String("output")
+	if output != "table" && output != "json" {
+		return fmt.Errorf("invalid output format %s", output)
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	info, err := m.InspectImage(image)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		data, err := json.MarshalIndent(info, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	printImageInspection(info)
+	return nil
+}
+
+func printImageInspection(info *oc.ImageInspection) {
+	fmt.Printf("%-14s %s\n", "Name:", info.Name)
+	fmt.Printf("%-14s %s\n", "Image ID:", info.ImageID)
+	if info.Created != nil {
+		fmt.Printf("%-14s %s\n", "Created:", getCreated(info.Created.Unix()))
+	}
+	fmt.Printf("%-14s %s/%s\n", "Platform:", info.OS, info.Architecture)
+	fmt.Printf("%-14s %v\n", "Service:", info.HasService)
+
+	var labels []string
+	for k := range info.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	if len(labels) > 0 {
+		fmt.Println("\nLabels:")
+		for _, k := range labels {
+			fmt.Printf("  %s=%s\n", k, info.Labels[k])
+		}
+	}
+
+	fmt.Println()
+	fmtString := "%-73s %-14s %-14s\n"
+	fmt.Printf(fmtString, "LAYER", "SIZE", "UNCOMPRESSED")
+	for _, l := range info.Layers {
+		fmt.Printf(fmtString, l.Digest, fmt.Sprintf("%d", l.Size), fmt.Sprintf("%d", l.UncompressedSize))
+	}
+
+	if len(info.Variables) > 0 {
+		fmt.Println()
+		fmtString = "%-20s %-10s %-30s %s\n"
+		fmt.Printf(fmtString, "VARIABLE", "KIND", "DEFAULT", "USED IN")
+		for _, v := range info.Variables {
+			kind, def := "required", "-"
+			if v.Default != nil {
+				kind, def = "default", *v.Default
+			} else if v.Automatic {
+				kind = "automatic"
+			}
+			fmt.Printf(fmtString, v.Name, kind, def, strings.Join(v.Files, ", "))
+		}
+	}
+
+	if len(info.HostFiles) > 0 {
+		fmt.Println("\nFiles copied to the host:")
+		for _, f := range info.HostFiles {
+			fmt.Printf("  %s\n", f)
+		}
+	}
+}
+
+func saveImages(c *cli.Context) error {
+	output := c.String("output")
+	if len(c.Args()) == 0 || output == "" {
+		return fmt.Errorf("at least an image and the --output file must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.SaveImages(output, c.Args())
+}
+
+func loadImages(c *cli.Context) error {
+	input := c.Args().First()
+	if input == "" {
+		return fmt.Errorf("an archive must be specified")
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	loaded, err := m.LoadImages(input)
+	for _, i := range loaded {
+		fmt.Printf("loaded %s\n", i)
+	}
+	return err
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	oc "github.com/giuseppe/os-containers/pkg/os-containers"
@@ -21,6 +22,34 @@ func getInstallCommand() cli.Command {
 				Name:  "name",
 				Usage: "specify the name for the container",
 			},
+			cli.BoolFlag{
+				Name:  "start",
+				Usage: "start the container once it is installed",
+			},
+			cli.StringSliceFlag{
+				Name:  "secret",
+				Usage: "specify a secret in the NAME=FILE form",
+			},
+			cli.StringSliceFlag{
+				Name:  "security-opt",
+				Usage: "specify a security option: label=OPTION, seccomp=FILE or apparmor=PROFILE",
+			},
+			cli.StringFlag{
+				Name:  "seccomp-profile",
+				Usage: "use the seccomp profile in FILE, or unconfined",
+			},
+			cli.StringFlag{
+				Name:  "apparmor-profile",
+				Usage: "use the loaded AppArmor profile PROFILE, or unconfined",
+			},
+			cli.BoolFlag{
+				Name:  "yes, y",
+				Usage: "accept the privileges of the container without asking",
+			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "install the image even if it is built for another platform",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			return installContainer(c)
@@ -38,8 +67,58 @@ func installContainer(c *cli.Context) error {
 		}
 		set[k[0]] = k[1]
 	}
+	secrets, err := parseSecrets(c.StringSlice("secret"))
+	if err != nil {
+		return err
+	}
+	securityOpts, err := parseSecurityOpts(c)
+	if err != nil {
+		return err
+	}
 	name := c.String("name")
 	image := c.Args().First()
-	ctx := readContext(c)
-	return oc.InstallContainer(name, image, set, ctx)
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.Install(name, image, set, oc.InstallOptions{
+		Start:        c.Bool("start"),
+		Force:        c.Bool("force"),
+		Secrets:      secrets,
+		SecurityOpts: securityOpts,
+		Confirm:      confirmPrivileges(c),
+	})
+}
+
+// parseSecurityOpts collects the --security-opt options and the
+// profiles specified with --seccomp-profile and --apparmor-profile.
+func parseSecurityOpts(c *cli.Context) ([]string, error) {
+	opts := c.StringSlice("security-opt")
+	if p := c.String("seccomp-profile"); p != "" {
+		if p != "unconfined" {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return nil, err
+			}
+			p = abs
+		}
+		opts = append(opts, "seccomp="+p)
+	}
+	if p := c.String("apparmor-profile"); p != "" {
+		opts = append(opts, "apparmor="+p)
+	}
+	return opts, nil
+}
+
+// parseSecrets parses secrets in the NAME=FILE form.
+func parseSecrets(args []string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	for _, s := range args {
+		k := strings.SplitN(s, "=", 2)
+		if len(k) != 2 || k[0] == "" || k[1] == "" {
+			return nil, fmt.Errorf("invalid secret %s", s)
+		}
+		secrets[k[0]] = k[1]
+	}
+	return secrets, nil
 }
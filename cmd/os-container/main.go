@@ -8,11 +8,23 @@ import (
 	"github.com/urfave/cli"
 )
 
-func readContext(c *cli.Context) *oc.Context {
-	ctx := &oc.Context{
-		Runtime: c.Parent().String("runtime"),
+func newManager(c *cli.Context) (*oc.Manager, error) {
+	opts, err := oc.DefaultOptions()
+	if err != nil {
+		return nil, err
+	}
+	if runtime := c.GlobalString("runtime"); runtime != "" {
+		opts.Runtime = runtime
+	}
+	if root := c.GlobalString("root"); root != "" {
+		opts.Root = root
 	}
-	return ctx
+	if registry := c.GlobalString("registry"); registry != "" {
+		opts.Registry = registry
+	}
+	opts.SkipHooks = c.GlobalBool("skip-hooks")
+	opts.Input = os.Stdin
+	return oc.NewManager(opts)
 }
 
 func main() {
@@ -22,7 +34,19 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "runtime",
-			Usage: "specify the runtime to use",
+			Usage: "specify the name or the path of the runtime to use",
+		},
+		cli.StringFlag{
+			Name:  "registry",
+			Usage: "use the specified registry for short image names",
+		},
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "install into an alternate root without using the running systemd",
+		},
+		cli.BoolFlag{
+			Name:  "skip-hooks",
+			Usage: "do not run the install, update and uninstall hooks of the images",
 		},
 	}
 	app.Commands = []cli.Command{
@@ -34,6 +58,8 @@ func main() {
 		getUpdateCommand(),
 		getRollbackCommand(),
 		getRunCommand(),
+		getApplyCommand(),
+		getDfCommand(),
 	}
 	err := app.Run(os.Args)
 	if err != nil {
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	oc "github.com/giuseppe/os-containers/pkg/os-containers"
+	"github.com/urfave/cli"
+)
+
+func printPrivileges(summary, added *oc.PrivilegeSummary) {
+	sections := []struct {
+		title        string
+		items, added []string
+	}{
+		{"Host namespaces", summary.HostNamespaces, added.HostNamespaces},
+		{"Capabilities", summary.Capabilities, added.Capabilities},
+		{"Host mounts", summary.HostMounts, added.HostMounts},
+		{"Devices", summary.Devices, added.Devices},
+		{"Unconfined", summary.Unconfined, added.Unconfined},
+		{"Host files", summary.HostFiles, added.HostFiles},
+		{"Units", summary.Units, added.Units},
+	}
+	fmt.Println("The container requires these privileges, the new ones are marked with +:")
+	for _, s := range sections {
+		if len(s.items) == 0 {
+			continue
+		}
+		isNew := make(map[string]bool)
+		for _, a := range s.added {
+			isNew[a] = true
+		}
+		fmt.Printf("%s:\n", s.title)
+		for _, i := range s.items {
+			mark := " "
+			if isNew[i] {
+				mark = "+"
+			}
+			fmt.Printf("  %s %s\n", mark, i)
+		}
+	}
+}
+
+// confirmPrivileges returns the function that shows the privileges of
+// the container and asks to confirm them, unless --yes is used.
+func confirmPrivileges(c *cli.Context) oc.ConfirmFunc {
+	yes := c.Bool("yes")
+	return func(summary, added *oc.PrivilegeSummary) (bool, error) {
+		printPrivileges(summary, added)
+		if yes {
+			return true, nil
+		}
+		if st, err := os.Stdin.Stat(); err != nil || st.Mode()&os.ModeCharDevice == 0 {
+			return false, fmt.Errorf("the privileges of the container grow, use --yes to confirm them")
+		}
+		fmt.Print("Continue? [y/N] ")
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes", nil
+	}
+}
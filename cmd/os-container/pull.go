@@ -1,14 +1,19 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strings"
+
 	oc "github.com/giuseppe/os-containers/pkg/os-containers"
 	"github.com/urfave/cli"
 )
 
 func getPullCommand() cli.Command {
 	return cli.Command{
-		Name:  "pull",
-		Usage: "list containers",
+		Name:      "pull",
+		Usage:     "pull images",
+		ArgsUsage: "IMAGE...",
 		Flags: []cli.Flag{
 			cli.BoolFlag{
 				Name:  "all",
@@ -18,6 +23,27 @@ func getPullCommand() cli.Command {
 				Name:  "insecure",
 				Usage: "allow to pull from an insecure registry",
 			},
+			cli.BoolFlag{
+				Name:  "quiet, q",
+				Usage: "do not show the progress",
+			},
+			cli.StringFlag{
+				Name:  "arch",
+				Usage: "select the architecture from a manifest list",
+			},
+			cli.StringFlag{
+				Name:  "variant",
+				Usage: "select the architecture variant from a manifest list",
+			},
+			cli.StringFlag{
+				Name:  "os",
+				Usage: "select the OS from a manifest list",
+			},
+			cli.StringFlag{
+				Name:  "progress",
+				Usage: "specify the progress format, either \"bar\" or \"json\"",
+				Value: "bar",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			return pullImage(c)
@@ -26,6 +52,43 @@ func getPullCommand() cli.Command {
 }
 
 func pullImage(c *cli.Context) error {
-	insecure := c.Bool("insecure")
-	return oc.PullImage(insecure, c.Args().First())
+	if len(c.Args()) == 0 {
+		return fmt.Errorf("at least an image must be specified")
+	}
+	progress := c.String("progress")
+	if progress != "bar" && progress != "json" {
+		return fmt.Errorf("invalid progress format %s", progress)
+	}
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	opts := oc.PullOptions{
+		Insecure:     c.Bool("insecure"),
+		Quiet:        c.Bool("quiet"),
+		JSONProgress: progress == "json",
+		Platform: oc.Platform{
+			OS:           c.String("os"),
+			Architecture: c.String("arch"),
+			Variant:      c.String("variant"),
+		},
+	}
+
+	var failed []string
+	for _, r := range m.PullImages(c.Args(), opts) {
+		if r.Err != nil {
+			if !opts.JSONProgress {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", r.Image, r.Err)
+			}
+			failed = append(failed, r.Image)
+			continue
+		}
+		if !opts.JSONProgress {
+			fmt.Printf("%s %s\n", r.Image, r.Digest)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to pull: %s", strings.Join(failed, ", "))
+	}
+	return nil
 }
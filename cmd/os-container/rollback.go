@@ -1,7 +1,6 @@
 package main
 
 import (
-	oc "github.com/giuseppe/os-containers/pkg/os-containers"
 	"github.com/urfave/cli"
 )
 
@@ -16,6 +15,10 @@ func getRollbackCommand() cli.Command {
 }
 
 func rollbackContainer(c *cli.Context) error {
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
 	name := c.Args().First()
-	return oc.RollbackContainer(name)
+	return m.Rollback(name)
 }
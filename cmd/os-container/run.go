@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"strings"
 
-	oc "github.com/giuseppe/os-containers/pkg/os-containers"
 	"github.com/urfave/cli"
 )
 
@@ -36,6 +35,9 @@ func runCommand(c *cli.Context) error {
 	}
 	container := c.Args().First()
 	cmd := []string(c.Args())[1:]
-	ctx := readContext(c)
-	return oc.RunCommand(container, cmd, set, ctx)
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.Run(container, cmd, set)
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	oc "github.com/giuseppe/os-containers/pkg/os-containers"
 	"github.com/urfave/cli"
 )
 
@@ -9,6 +8,12 @@ func getUninstallCommand() cli.Command {
 	return cli.Command{
 		Name:  "uninstall",
 		Usage: "uninstall a container",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "purge",
+				Usage: "delete also the volumes of the container",
+			},
+		},
 		Action: func(c *cli.Context) error {
 			return uninstallContainer(c)
 		},
@@ -16,6 +21,10 @@ func getUninstallCommand() cli.Command {
 }
 
 func uninstallContainer(c *cli.Context) error {
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
 	name := c.Args().First()
-	return oc.UninstallContainer(name)
+	return m.Uninstall(name, c.Bool("purge"))
 }
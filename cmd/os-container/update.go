@@ -17,10 +17,38 @@ func getUpdateCommand() cli.Command {
 				Name:  "set",
 				Usage: "specify a variable in the VARIABLE=VALUE form",
 			},
+			cli.StringSliceFlag{
+				Name:  "secret",
+				Usage: "add or replace a secret in the NAME=FILE form",
+			},
+			cli.StringSliceFlag{
+				Name:  "security-opt",
+				Usage: "replace the security options of the same kind: label=OPTION, seccomp=FILE or apparmor=PROFILE",
+			},
+			cli.StringFlag{
+				Name:  "seccomp-profile",
+				Usage: "use the seccomp profile in FILE, or unconfined",
+			},
+			cli.StringFlag{
+				Name:  "apparmor-profile",
+				Usage: "use the loaded AppArmor profile PROFILE, or unconfined",
+			},
 			cli.StringFlag{
 				Name:  "rebase",
 				Usage: "specify a different image",
 			},
+			cli.StringFlag{
+				Name:  "runtime",
+				Usage: "switch the container to a different runtime",
+			},
+			cli.BoolFlag{
+				Name:  "yes, y",
+				Usage: "accept the new privileges of the container without asking",
+			},
+			cli.BoolFlag{
+				Name:  "pull",
+				Usage: "pull the image before updating the container",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			return updateContainer(c)
@@ -38,9 +66,30 @@ func updateContainer(c *cli.Context) error {
 		}
 		set[k[0]] = k[1]
 	}
-	rebase := c.String("rebase")
+	secrets, err := parseSecrets(c.StringSlice("secret"))
+	if err != nil {
+		return err
+	}
+	securityOpts, err := parseSecurityOpts(c)
+	if err != nil {
+		return err
+	}
+	runtime := c.String("runtime")
+	if runtime == "" {
+		runtime = c.GlobalString("runtime")
+	}
 
 	name := c.Args().First()
-	ctx := readContext(c)
-	return oc.UpdateContainer(name, set, rebase, ctx)
+	m, err := newManager(c)
+	if err != nil {
+		return err
+	}
+	return m.Update(name, set, oc.UpdateOptions{
+		Rebase:       c.String("rebase"),
+		Runtime:      runtime,
+		Pull:         c.Bool("pull"),
+		Secrets:      secrets,
+		SecurityOpts: securityOpts,
+		Confirm:      confirmPrivileges(c),
+	})
 }
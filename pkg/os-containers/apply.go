@@ -0,0 +1,254 @@
+package oscontainers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	ApplyInstall   = "install"
+	ApplyUpdate    = "update"
+	ApplyUninstall = "uninstall"
+	ApplyNone      = "none"
+)
+
+type DesiredContainer struct {
+	Name    string            `yaml:"name"`
+	Image   string            `yaml:"image"`
+	Runtime string            `yaml:"runtime"`
+	Values  map[string]string `yaml:"values"`
+}
+
+type DesiredState struct {
+	Containers []DesiredContainer `yaml:"containers"`
+}
+
+type AppliedChange struct {
+	Name    string
+	Action  string
+	Reasons []string
+}
+
+func ReadDesiredState(path string) (*DesiredState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", path)
+	}
+
+	var state DesiredState
+	if err := yaml.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", path)
+	}
+
+	seen := make(map[string]bool)
+	for i := range state.Containers {
+		c := &state.Containers[i]
+		if c.Image == "" {
+			return nil, fmt.Errorf("%s: no image specified for container #%d", path, i+1)
+		}
+		if c.Name == "" {
+			srcRef, err := parseImageName(c.Image)
+			if err != nil {
+				return nil, err
+			}
+			c.Name = getDefaultContainerName(srcRef.DockerReference())
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("%s: the container %s is specified more than once", path, c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return &state, nil
+}
+
+func normalizeImageName(image string) (string, error) {
+	srcRef, err := parseImageName(image)
+	if err != nil {
+		return "", err
+	}
+	return srcRef.DockerReference().String(), nil
+}
+
+// removedValues returns the values set for ctr that desired doesn't
+// list anymore.
+func removedValues(desired *DesiredContainer, ctr *Container) []string {
+	var ret []string
+	for _, k := range ctr.SetValues {
+		if _, ok := desired.Values[k]; !ok {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+// sameRuntime tells whether two runtimes, given by name or by path,
+// resolve to the same executable and arguments.
+func (m *Manager) sameRuntime(a, b string) (bool, error) {
+	pa, err := m.runtimeProfile(a)
+	if err != nil {
+		return false, err
+	}
+	pb, err := m.runtimeProfile(b)
+	if err != nil {
+		return false, err
+	}
+	return pa.Path == pb.Path && strings.Join(pa.Args, " ") == strings.Join(pb.Args, " "), nil
+}
+
+func (m *Manager) planContainerChange(repo *OSTreeRepo, desired *DesiredContainer, ctr *Container) (*AppliedChange, error) {
+	change := &AppliedChange{
+		Name:   desired.Name,
+		Action: ApplyNone,
+	}
+	if ctr == nil {
+		change.Action = ApplyInstall
+		return change, nil
+	}
+
+	desiredImage, err := normalizeImageName(desired.Image)
+	if err != nil {
+		return nil, err
+	}
+	currentImage, err := normalizeImageName(ctr.Image)
+	if err != nil {
+		return nil, err
+	}
+	if desiredImage != currentImage {
+		change.Reasons = append(change.Reasons, "image")
+	} else {
+		branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(desiredImage))
+		found, imageID, err := repo.readMetadata(branch, "docker.digest")
+		if err == nil && found && strings.TrimPrefix(imageID, "sha256:") != ctr.Revision {
+			change.Reasons = append(change.Reasons, "revision")
+		}
+	}
+
+	changedValues := len(removedValues(desired, ctr)) > 0
+	for k, v := range desired.Values {
+		if cur, ok := ctr.Values[k]; !ok || fmt.Sprintf("%v", cur) != v {
+			changedValues = true
+			break
+		}
+	}
+	if changedValues {
+		change.Reasons = append(change.Reasons, "values")
+	}
+
+	if desired.Runtime != "" {
+		same, err := m.sameRuntime(desired.Runtime, ctr.Runtime)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			change.Reasons = append(change.Reasons, "runtime")
+		}
+	}
+
+	if len(change.Reasons) > 0 {
+		change.Action = ApplyUpdate
+	}
+	return change, nil
+}
+
+func (m *Manager) applyContainerChange(repo *OSTreeRepo, desired *DesiredContainer, ctr *Container, change *AppliedChange, confirm ConfirmFunc) error {
+	values := make(map[string]string)
+	for k, v := range desired.Values {
+		values[k] = v
+	}
+
+	switch change.Action {
+	case ApplyInstall:
+		return m.withRuntime(desired.Runtime).Install(desired.Name, desired.Image, values, InstallOptions{Confirm: confirm})
+	case ApplyUpdate:
+		desiredImage, err := normalizeImageName(desired.Image)
+		if err != nil {
+			return err
+		}
+		branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(desiredImage))
+		hasBranch, err := repo.hasBranch(branch)
+		if err != nil {
+			return err
+		}
+
+		var rebase string
+		for _, r := range change.Reasons {
+			if r == "image" {
+				rebase = desired.Image
+			}
+		}
+		return m.Update(desired.Name, values, UpdateOptions{
+			Rebase:  rebase,
+			Runtime: desired.Runtime,
+			Pull:    !hasBranch,
+			Unset:   removedValues(desired, ctr),
+			Confirm: confirm,
+		})
+	}
+	return nil
+}
+
+func (m *Manager) Apply(state *DesiredState, prune, dryRun bool, confirm ConfirmFunc) ([]AppliedChange, error) {
+	repoPath := m.repoPath
+	if err := ensureRepoExists(repoPath, m.rootless); err != nil {
+		return nil, err
+	}
+	repo, err := openRepo(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := m.List()
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+	installed := make(map[string]*Container)
+	for i := range containers {
+		installed[containers[i].Name] = &containers[i]
+	}
+
+	changes := []AppliedChange{}
+	for i := range state.Containers {
+		desired := &state.Containers[i]
+		ctr := installed[desired.Name]
+
+		desired.Image, err = m.resolveImageName(desired.Image)
+		if err != nil {
+			return changes, err
+		}
+
+		change, err := m.planContainerChange(repo, desired, ctr)
+		if err != nil {
+			return changes, err
+		}
+		if !dryRun {
+			if err := m.applyContainerChange(repo, desired, ctr, change, confirm); err != nil {
+				return changes, errors.Wrapf(err, "%s %s", change.Action, desired.Name)
+			}
+		}
+		changes = append(changes, *change)
+		delete(installed, desired.Name)
+	}
+
+	if prune {
+		var names []string
+		for name := range installed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !dryRun {
+				if err := m.Uninstall(name, false); err != nil {
+					return changes, errors.Wrapf(err, "uninstall %s", name)
+				}
+			}
+			changes = append(changes, AppliedChange{Name: name, Action: ApplyUninstall})
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,312 @@
+package oscontainers
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/copy"
+	"github.com/containers/image/directory"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/image"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/signature"
+	"github.com/containers/image/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	bundleIndexName    = "index.json"
+	bundleImagesDir    = "images"
+	bundleImagesPrefix = bundleImagesDir + "/"
+)
+
+type bundleImage struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+	Path   string `json:"path"`
+}
+
+type bundleIndex struct {
+	Images []bundleImage `json:"images"`
+}
+
+// namedUnparsedImage allows to check the signatures of an image stored
+// in a directory as if it came from the registry it was pulled from.
+type namedUnparsedImage struct {
+	*image.UnparsedImage
+	ref types.ImageReference
+}
+
+func (i *namedUnparsedImage) Reference() types.ImageReference {
+	return i.ref
+}
+
+func (m *Manager) SaveImages(output string, images []string) error {
+	if len(images) == 0 {
+		return fmt.Errorf("no images specified")
+	}
+	repo, err := openRepo(m.repoPath)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "os-container")
+	if err != nil {
+		return errors.Wrapf(err, "create temporary directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	policyContext, err := m.getPolicyContext()
+	if err != nil {
+		return err
+	}
+	defer policyContext.Destroy()
+
+	var index bundleIndex
+	for i, name := range images {
+		name, err := m.resolveImageName(name)
+		if err != nil {
+			return err
+		}
+		srcRef, err := parseImageName(name)
+		if err != nil {
+			return err
+		}
+		dockerRef := srcRef.DockerReference()
+		branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(dockerRef.String()))
+		found, digest, err := repo.readMetadata(branch, "docker.digest")
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("cannot find the image %s", name)
+		}
+
+		ostreeRef, err := getOSTreeReference(srcRef, m.repoPath)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(bundleImagesDir, fmt.Sprintf("%d", i))
+		if err := os.MkdirAll(filepath.Join(tmpDir, path), 0700); err != nil {
+			return errors.Wrapf(err, "create %s", path)
+		}
+		destRef, err := directory.NewReference(filepath.Join(tmpDir, path))
+		if err != nil {
+			return err
+		}
+		m.logger.Printf("saving %s\n", dockerRef.String())
+		err = copy.Image(m.ctx, policyContext, destRef, ostreeRef, &copy.Options{
+			ReportWriter: m.output,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "save %s", dockerRef.String())
+		}
+		index.Images = append(index.Images, bundleImage{
+			Name:   dockerRef.String(),
+			Digest: digest,
+			Path:   path,
+		})
+	}
+
+	indexFile := filepath.Join(tmpDir, bundleIndexName)
+	indexData, err := json.Marshal(&index)
+	if err != nil {
+		return errors.Wrapf(err, "marshal JSON")
+	}
+	if err := ioutil.WriteFile(indexFile, indexData, 0600); err != nil {
+		return errors.Wrapf(err, "write %s", indexFile)
+	}
+
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", output)
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	err = func() error {
+		if err := addToTar(tw, indexFile, bundleIndexName); err != nil {
+			return err
+		}
+		if err := addToTar(tw, filepath.Join(tmpDir, bundleImagesDir), bundleImagesDir); err != nil {
+			return err
+		}
+		return tw.Close()
+	}()
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) verifyBundleImage(policyContext *signature.PolicyContext, img *bundleImage, srcRef types.ImageReference) error {
+	named, err := parseImageName(img.Name)
+	if err != nil {
+		return err
+	}
+	dockerRef, err := docker.NewReference(named.DockerReference())
+	if err != nil {
+		return err
+	}
+
+	src, err := srcRef.NewImageSource(m.ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", img.Path)
+	}
+	defer src.Close()
+
+	/* Before the image is copied, so that a mismatching image doesn't
+	   replace the one in the repository.  */
+	manifestBlob, _, err := src.GetManifest(m.ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "read the manifest of %s", img.Name)
+	}
+	digest, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return errors.Wrapf(err, "compute the digest of %s", img.Name)
+	}
+	if digest.String() != img.Digest {
+		return fmt.Errorf("the digest of %s is %s, expected %s", img.Name, digest, img.Digest)
+	}
+
+	unparsed := &namedUnparsedImage{
+		UnparsedImage: image.UnparsedInstance(src, nil),
+		ref:           dockerRef,
+	}
+	allowed, err := policyContext.IsRunningImageAllowed(m.ctx, unparsed)
+	if err != nil {
+		return errors.Wrapf(err, "the image %s is rejected by the signature policy", img.Name)
+	}
+	if !allowed {
+		return fmt.Errorf("the image %s is rejected by the signature policy", img.Name)
+	}
+	return nil
+}
+
+func (m *Manager) LoadImages(input string) ([]string, error) {
+	repoPath := m.repoPath
+	if err := ensureRepoExists(repoPath, m.rootless); err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "os-container")
+	if err != nil {
+		return nil, errors.Wrapf(err, "create temporary directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var index *bundleIndex
+	err = walkTar(input, func(hdr *tar.Header, r io.Reader) error {
+		name := filepath.Clean(hdr.Name)
+		if name == bundleIndexName {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			index = &bundleIndex{}
+			return json.Unmarshal(data, index)
+		}
+		if name != bundleImagesDir && !strings.HasPrefix(name, bundleImagesPrefix) {
+			return fmt.Errorf("the archive contains the unexpected file %s", hdr.Name)
+		}
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("the archive contains the unexpected entry %s", hdr.Name)
+		}
+		return m.extractTarEntry(hdr, r, filepath.Join(tmpDir, name))
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", input)
+	}
+	if index == nil {
+		return nil, fmt.Errorf("%s is not an images bundle", input)
+	}
+
+	policyContext, err := m.getPolicyContext()
+	if err != nil {
+		return nil, err
+	}
+	defer policyContext.Destroy()
+
+	/* The signatures were already verified.  */
+	acceptPolicyContext, err := signature.NewPolicyContext(&signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer acceptPolicyContext.Destroy()
+
+	repo, err := openRepo(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded []string
+	for i := range index.Images {
+		img := &index.Images[i]
+		path := filepath.Clean(img.Path)
+		if !strings.HasPrefix(path, bundleImagesPrefix) {
+			return loaded, fmt.Errorf("invalid path %s for the image %s", img.Path, img.Name)
+		}
+		srcRef, err := directory.NewReference(filepath.Join(tmpDir, path))
+		if err != nil {
+			return loaded, err
+		}
+		if err := m.verifyBundleImage(policyContext, img, srcRef); err != nil {
+			return loaded, err
+		}
+
+		named, err := parseImageName(img.Name)
+		if err != nil {
+			return loaded, err
+		}
+		destRef, err := getOSTreeReference(named, repoPath)
+		if err != nil {
+			return loaded, err
+		}
+		branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(named.DockerReference().String()))
+		hasBranch, err := repo.hasBranch(branch)
+		if err != nil {
+			return loaded, err
+		}
+		var previous string
+		if hasBranch {
+			if previous, err = repo.resolveCommit(branch); err != nil {
+				return loaded, err
+			}
+		}
+
+		m.logger.Printf("loading %s\n", img.Name)
+		err = copy.Image(m.ctx, acceptPolicyContext, destRef, srcRef, &copy.Options{
+			ReportWriter: m.output,
+		})
+		if err != nil {
+			return loaded, errors.Wrapf(err, "load %s", img.Name)
+		}
+
+		_, digest, err := repo.readMetadata(branch, "docker.digest")
+		if err == nil && digest != img.Digest {
+			err = fmt.Errorf("the digest of %s is %s, expected %s", img.Name, digest, img.Digest)
+		}
+		if err != nil {
+			/* Put back the image that was replaced.  */
+			if previous != "" {
+				if err2 := repo.setBranch(branch, previous); err2 != nil {
+					m.logger.Printf("could not restore the previous image %s: %v\n", img.Name, err2)
+				}
+			} else if err2 := repo.deleteBranch(branch); err2 != nil {
+				m.logger.Printf("could not delete the image %s: %v\n", img.Name, err2)
+			}
+			return loaded, err
+		}
+		loaded = append(loaded, img.Name)
+	}
+	return loaded, nil
+}
@@ -6,17 +6,19 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mrunalp/fileutils"
 	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
 )
@@ -96,21 +98,26 @@ func checkConfigHasPidfile(file string) (bool, error) {
 	return strings.Contains(string(data), "PIDFILE"), nil
 }
 
-func setSystemdStartup(runtime, srcFile, name string, values map[string]string) error {
+func setSystemdStartup(profile *RuntimeProfile, srcFile, name string, values map[string]string) error {
 	hasPidFile, err := checkConfigHasPidfile(srcFile)
 	if err != nil {
 		return errors.Wrapf(err, "check pid file %s", srcFile)
 	}
+	runtime := strings.Join(append([]string{profile.Path}, profile.Args...), " ")
+	runOptions := "run"
+	if profile.SystemdCgroup {
+		runOptions = "--systemd-cgroup run"
+	}
 	var start, stop, stoppost, prestart string
-	if hasPidFile {
+	if hasPidFile && profile.PidFile {
 		if _, found := values["PIDFILE"]; !found {
 			values["PIDFILE"] = filepath.Join(values["RUN_DIRECTORY"], fmt.Sprintf("container-%s.pid", name))
 		}
 		pidfile := values["PIDFILE"]
-		start = fmt.Sprintf("%s --systemd-cgroup run -d --pidfile %s '%s'", runtime, pidfile, name)
+		start = fmt.Sprintf("%s %s -d --pidfile %s '%s'", runtime, runOptions, pidfile, name)
 		stoppost = fmt.Sprintf("%s delete '%s'", runtime, name)
 	} else {
-		start = fmt.Sprintf("%s --systemd-cgroup run '%s'", runtime, name)
+		start = fmt.Sprintf("%s %s '%s'", runtime, runOptions, name)
 		stop = fmt.Sprintf("%s kill '%s'", runtime, name)
 	}
 	values["EXEC_START"] = start
@@ -120,17 +127,13 @@ func setSystemdStartup(runtime, srcFile, name string, values map[string]string)
 	return nil
 }
 
-func amendValues(name, image, imageID string, values map[string]string) error {
-	root := os.Geteuid() == 0
+func (m *Manager) amendValues(name, image, imageID string, values map[string]string) error {
+	root := !m.rootless
 	if _, found := values["RUN_DIRECTORY"]; !found {
 		if root {
 			values["RUN_DIRECTORY"] = "/run"
 		} else {
-			runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
-			if runtimeDir == "" {
-				runtimeDir = fmt.Sprintf("/run/user/%d", os.Geteuid())
-			}
-			values["RUN_DIRECTORY"] = runtimeDir
+			values["RUN_DIRECTORY"] = m.runtimeDir
 		}
 	}
 
@@ -138,7 +141,7 @@ func amendValues(name, image, imageID string, values map[string]string) error {
 		if root {
 			values["CONF_DIRECTORY"] = "/etc"
 		} else {
-			values["RUN_DIRECTORY"] = filepath.Join(os.Getenv("HOME"), ".config")
+			values["CONF_DIRECTORY"] = filepath.Join(m.home, ".config")
 		}
 	}
 
@@ -146,34 +149,112 @@ func amendValues(name, image, imageID string, values map[string]string) error {
 		if root {
 			values["STATE_DIRECTORY"] = "/var/lib"
 		} else {
-			values["STATE_DIRECTORY"] = filepath.Join(os.Getenv("HOME"), ".data")
+			values["STATE_DIRECTORY"] = filepath.Join(m.home, ".data")
 		}
 	}
 	if _, found := values["UUID"]; !found {
 		values["UUID"] = uuid.Must(uuid.NewV4()).String()
 	}
 
-	values["HOST_UID"] = fmt.Sprintf("%d", os.Geteuid())
-	values["HOST_GID"] = fmt.Sprintf("%d", os.Getegid())
+	values["HOST_UID"] = fmt.Sprintf("%d", m.uid)
+	values["HOST_GID"] = fmt.Sprintf("%d", m.gid)
 	values["IMAGE_NAME"] = image
 	values["IMAGE_ID"] = imageID
 
 	return nil
 }
 
-func generateDefaultConfigFile(runtime, destConfig string) error {
+func (m *Manager) generateDefaultConfigFile(profile *RuntimeProfile, destConfig string) error {
 	var cmd *exec.Cmd
-	if os.Geteuid() == 0 {
-		cmd = exec.Command(runtime, "spec")
+	if !m.rootless {
+		cmd = m.runtimeExec(profile, "spec")
 	} else {
-		cmd = exec.Command(runtime, "spec", "--rootless")
+		cmd = m.runtimeExec(profile, "spec", "--rootless")
 	}
 	cmd.Dir = path.Dir(destConfig)
 	return cmd.Run()
 }
 
-func checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set map[string]string, name, image, imageID string, checkoutNumber int, ctx *Context) (*Container, error) {
-	runtimePath := getRuntime(ctx)
+// checkoutLayer checks out a layer in checkout.  The files are hard
+// links to the repository, unless copy is set.
+func (m *Manager) checkoutLayer(repo *OSTreeRepo, layer string, checkout string, copy bool) error {
+	if err := os.MkdirAll(checkout, 0700); err != nil {
+		return errors.Wrapf(err, "create %s", checkout)
+	}
+
+	dir, err := os.Open(checkout)
+	if err != nil {
+		return errors.Wrapf(err, "open dir %s", checkout)
+	}
+	defer dir.Close()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := repo.unionCheckout(layer, int(dir.Fd()), checkout, m.rootless, copy); err != nil {
+		return errors.Wrapf(err, "checkout %s", layer)
+	}
+	return nil
+}
+
+// checkoutLayers assembles the rootfs from the layers, applying the
+// whiteouts of each layer to the layers below it.  The whiteouts of
+// each layer but the first are read from the tree of its commit before
+// it is merged.
+func (m *Manager) checkoutLayers(repo *OSTreeRepo, layers []string, checkout string, copy bool) error {
+	for i, l := range layers {
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		if i > 0 {
+			whiteouts, err := readLayerWhiteouts(repo, l)
+			if err != nil {
+				return err
+			}
+			if err := applyWhiteouts(checkout, whiteouts); err != nil {
+				return err
+			}
+			if err := m.checkoutLayer(repo, l, checkout, copy); err != nil {
+				return err
+			}
+			if err := removeWhiteoutMarkers(checkout, whiteouts); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := m.checkoutLayer(repo, l, checkout, copy); err != nil {
+			return err
+		}
+		whiteouts, err := readWhiteouts(checkout)
+		if err != nil {
+			return err
+		}
+		if err := removeWhiteoutMarkers(checkout, whiteouts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLayerWhiteouts(repo *OSTreeRepo, layer string) (*layerWhiteouts, error) {
+	ret := &layerWhiteouts{}
+	err := repo.walkLayer(layer, "", func(path string, isDir bool) error {
+		if ret.add(path) && isDir {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "read the whiteouts of %s", layer)
+	}
+	return ret, nil
+}
+
+func (m *Manager) checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set map[string]string, name, image, imageID string, checkoutNumber int) (_ *Container, retErr error) {
+	runtimeProfile, err := m.checkRuntimeProfile(m.runtime)
+	if err != nil {
+		return nil, err
+	}
 	found, manifest, err := repo.readMetadata(branch, "docker.manifest")
 	if err != nil {
 		return nil, err
@@ -190,23 +271,31 @@ func checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set
 	if err != nil {
 		return nil, errors.Wrapf(err, "read layers")
 	}
-	if err := os.MkdirAll(checkout, 0700); err != nil {
-		return nil, errors.Wrapf(err, "create %s", checkout)
+	securityOpts, err := parseSecurityOpts(m.securityOpts)
+	if err != nil {
+		return nil, err
 	}
-
-	dir, err := os.Open(checkout)
+	processLabel, mountLabel, err := m.containerLabels(checkouts, name, securityOpts.Label)
 	if err != nil {
-		return nil, errors.Wrapf(err, "open dir %s", checkout)
+		return nil, err
 	}
-	defer dir.Close()
-
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	for _, l := range layers {
-		err = repo.unionCheckout(l, int(dir.Fd()), checkout)
-		if err != nil {
-			return nil, errors.Wrapf(err, "checkout %s", l)
+	if m.overlay {
+		if err := m.checkoutOverlay(repo, layers, destDir, mountLabel); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if retErr != nil {
+				syscall.Unmount(checkout, 0)
+			}
+		}()
+	} else {
+		/* The hard links to the repository are shared with the other
+		   containers, so a labelled rootfs must be a copy.  */
+		if err := m.checkoutLayers(repo, layers, checkout, mountLabel != ""); err != nil {
+			return nil, err
+		}
+		if err := label.Relabel(checkout, mountLabel, false); err != nil {
+			return nil, errors.Wrapf(err, "relabel %s", checkout)
 		}
 	}
 
@@ -236,22 +325,26 @@ func checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set
 		}
 	}
 
+	for k, v := range m.values {
+		values[k] = v
+	}
+
 	for k, v := range set {
 		values[k] = v
 	}
 
-	err = amendValues(name, image, imageID, values)
+	err = m.amendValues(name, image, imageID, values)
 	if err != nil {
 		return nil, err
 	}
 
-	err = setSystemdStartup(runtimePath, srcServiceConfig, name, values)
+	err = setSystemdStartup(runtimeProfile, srcServiceConfig, name, values)
 	if err != nil {
 		return nil, err
 	}
 
 	values["NAME"] = name
-	values["DESTDIR"] = destDir
+	values["DESTDIR"] = m.stripRoot(destDir)
 
 	if containerManifest != nil {
 		newRenameFiles := make(map[string]string)
@@ -263,10 +356,20 @@ func checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set
 			newRenameFiles[k] = nv
 		}
 		containerManifest.RenameFiles = newRenameFiles
+
+		newStateDirectories := []string{}
+		for _, d := range containerManifest.StateDirectories {
+			nd, err := TemplateReplaceMemory(d, values)
+			if err != nil {
+				return nil, err
+			}
+			newStateDirectories = append(newStateDirectories, nd)
+		}
+		containerManifest.StateDirectories = newStateDirectories
 	}
 
 	if _, err := os.Stat(srcConfig); err != nil && os.IsNotExist(err) {
-		err = generateDefaultConfigFile(runtimePath, destConfig)
+		err = m.generateDefaultConfigFile(runtimeProfile, destConfig)
 		if err != nil {
 			return nil, errors.Wrapf(err, "cannot generate default config file")
 		}
@@ -277,12 +380,43 @@ func checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set
 		}
 	}
 
-	if os.Geteuid() != 0 {
-		err := makeOCIConfigurationRootless(destConfig); if err != nil {
+	if m.rootless {
+		err := m.makeOCIConfigurationRootless(destConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var volumes []ContainerVolume
+	var requiredSecrets []string
+	if containerManifest != nil {
+		volumes = containerManifest.Volumes
+		requiredSecrets = containerManifest.Secrets
+	}
+	if err := m.addVolumeMounts(name, destConfig, volumes); err != nil {
+		return nil, err
+	}
+
+	if err := m.applySecurityProfiles(securityOpts, name, checkout, destConfig); err != nil {
+		return nil, err
+	}
+
+	if processLabel != "" {
+		err := modifyOCIConfig(destConfig, func(g *generate.Generator) error {
+			g.SetProcessSelinuxLabel(processLabel)
+			g.SetLinuxMountLabel(mountLabel)
+			return nil
+		})
+		if err != nil {
 			return nil, err
 		}
 	}
 
+	secrets, err := m.setupSecrets(name, destConfig, requiredSecrets, mountLabel, values)
+	if err != nil {
+		return nil, err
+	}
+
 	err = TemplateWithDefaultGenerate(srcServiceConfig, destServiceConfig, defaultService, values)
 	if err != nil {
 		return nil, err
@@ -301,6 +435,7 @@ func checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set
 
 	var renameFiles map[string]string
 	var installedFilesTemplate []string
+	var stateDirectories []string
 	valuesForContainer := make(map[string]interface{})
 	for k, v := range values {
 		valuesForContainer[k] = v
@@ -308,6 +443,7 @@ func checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set
 	if containerManifest != nil {
 		renameFiles = containerManifest.RenameFiles
 		installedFilesTemplate = containerManifest.InstalledFilesTemplate
+		stateDirectories = containerManifest.StateDirectories
 	}
 
 	c := &Container{
@@ -317,18 +453,28 @@ func checkoutContainerTo(branch string, repo *OSTreeRepo, checkouts string, set
 		Revision:               imageID,
 		Image:                  image,
 		Created:                time.Now().Unix(),
-		Runtime:                runtimePath,
+		Runtime:                m.runtime,
 		InstalledFiles:         []string{},
 		InstalledFilesTemplate: installedFilesTemplate,
 		RenameInstalledFiles:   renameFiles,
+		StateDirectories:       stateDirectories,
 		Values:                 valuesForContainer,
+		Overlay:                m.overlay,
+		Volumes:                volumes,
+		Secrets:                secrets,
+		SecurityOpts:           m.securityOpts,
+		ProcessLabel:           processLabel,
+		MountLabel:             mountLabel,
 		values:                 values,
 	}
+	if m.overlay {
+		c.Layers = layers
+	}
 
 	return c, nil
 }
 
-func makeDeploymentActive(container *Container, checkouts string, name string, start bool, checkoutNumber int) error {
+func (m *Manager) makeDeploymentActive(container *Container, checkouts string, name string, start bool, checkoutNumber int) error {
 	destDir := filepath.Join(checkouts, fmt.Sprintf("%s.%d", name, checkoutNumber))
 	checkout := filepath.Join(destDir, "rootfs")
 
@@ -337,9 +483,19 @@ func makeDeploymentActive(container *Container, checkouts string, name string, s
 	srcTempFiles := filepath.Join(checkout, "exports/tmpfiles.template")
 	destTempFiles := filepath.Join(destDir, fmt.Sprintf("tmpfiles-%s.conf", name))
 
-	if os.Geteuid() == 0 {
+	if container.Overlay {
+		/* The rootfs of a rollback target is not mounted.  */
+		if err := m.mountOverlay(destDir, container.Layers, container.MountLabel); err != nil {
+			return err
+		}
+		if m.root != "" {
+			defer syscall.Unmount(checkout, 0)
+		}
+	}
+
+	if !m.rootless {
 		hostFS := filepath.Join(destDir, "rootfs/exports/hostfs")
-		copiedFiles, err := copyFilesToHost(hostFS, "/", container)
+		copiedFiles, err := m.copyFilesToHost(hostFS, "/", container)
 		if err != nil {
 			return err
 		}
@@ -351,49 +507,62 @@ func makeDeploymentActive(container *Container, checkouts string, name string, s
 		return err
 	}
 
+	if container.Overlay {
+		if err := m.activateOverlay(container, destDir); err != nil {
+			return err
+		}
+	}
+
+	/* Relative, so that it is valid also inside an alternate root.  */
 	destSymlink := filepath.Join(checkouts, name)
+	symlinkTarget := filepath.Base(destDir)
 
 	if !container.HasContainerService {
-		if err := os.Symlink(destDir, destSymlink); err != nil {
+		if err := os.Symlink(symlinkTarget, destSymlink); err != nil {
 			return errors.Wrapf(err, "create checkout symlink")
 		}
 		return nil
 	}
 
-	err := copyFile(destServiceConfig, filepath.Join(getSystemdDestination(), path.Base(destServiceConfig)))
+	err := copyFile(destServiceConfig, filepath.Join(m.unitsPath, path.Base(destServiceConfig)))
 	if err != nil {
 		return err
 	}
+	if err := m.installSecretsDropIn(name, destDir); err != nil {
+		return err
+	}
 
 	var tmpFiles string
 	var hasTempFiles bool
-	if os.Stat(srcTempFiles); err != nil {
+	if _, err := os.Stat(srcTempFiles); err == nil {
 		hasTempFiles = true
 	}
 	if hasTempFiles {
-		tmpFiles = filepath.Join(getSystemdTmpFilesDestination(), path.Base(destTempFiles))
+		tmpFiles = filepath.Join(m.tmpFilesPath, path.Base(destTempFiles))
 		err := copyFile(destTempFiles, tmpFiles)
 		if err != nil {
 			return err
 		}
 	}
 
-	if err := os.Symlink(destDir, destSymlink); err != nil {
+	if err := os.Symlink(symlinkTarget, destSymlink); err != nil {
 		return errors.Wrapf(err, "create checkout symlink")
 	}
 
-	_, err = systemctlCommand("daemon-reload", "", false, false)
-	if err != nil {
-		return err
+	if m.root == "" {
+		_, err = m.systemctlCommand("daemon-reload", "", false, false)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = systemctlCommand("enable", name, start, false)
-	if err != nil {
+	if err := m.enableUnit(name, start); err != nil {
 		return err
 	}
 
-	if hasTempFiles {
-		_, err := systemdTmpFilesCommand("--create", tmpFiles, false)
+	/* The tmpfiles are created on the next boot of the alternate root.  */
+	if hasTempFiles && m.root == "" {
+		_, err := m.systemdTmpFilesCommand("--create", tmpFiles, false)
 		if err != nil {
 			return err
 		}
@@ -402,24 +571,6 @@ func makeDeploymentActive(container *Container, checkouts string, name string, s
 	return nil
 }
 
-func getSystemdTmpFilesDestination() string {
-	if os.Geteuid() == 0 {
-		return "/etc/tmpfiles.d"
-	}
-	xdgDataDir := os.Getenv("XDG_DATA_DIR")
-	if xdgDataDir != "" {
-		return filepath.Join(xdgDataDir, "containers/tmpfiles")
-	}
-	return filepath.Join(os.Getenv("HOME"), ".containers/tmpfiles")
-}
-
-func getSystemdDestination() string {
-	if os.Geteuid() == 0 {
-		return "/etc/systemd/system"
-	}
-	return filepath.Join(os.Getenv("HOME"), ".config/systemd/user")
-}
-
 type CopiedFiles struct {
 	Copied   []string
 	Checksum map[string]string
@@ -440,13 +591,55 @@ func getFileChecksum(path string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-func copyFilesToHost(from string, to string, container *Container) (*CopiedFiles, error) {
+// hostFile is a file of exports/hostfs and where it is installed.
+type hostFile struct {
+	Source string
+	// Name is the path of the file relative to exports/hostfs, as
+	// used by the image manifest.
+	Name      string
+	Installed string
+	IsDir     bool
+}
+
+// hostFilesPlan lists the files in from and where they are installed
+// under to, with the renames required by the container.
+func hostFilesPlan(from string, to string, container *Container) ([]hostFile, error) {
+	var ret []hostFile
+	if _, err := os.Stat(from); err != nil && os.IsNotExist(err) {
+		return ret, nil
+	}
+	err := filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		installed := filepath.Join(to, rel)
+		canonicalName := fmt.Sprintf("/%s", rel)
+		if r, ok := container.RenameInstalledFiles[canonicalName]; ok {
+			installed = r
+		}
+		ret = append(ret, hostFile{
+			Source:    path,
+			Name:      canonicalName,
+			Installed: installed,
+			IsDir:     info.IsDir(),
+		})
+		return nil
+	})
+	return ret, err
+}
+
+func (m *Manager) copyFilesToHost(from string, to string, container *Container) (*CopiedFiles, error) {
 	ret := &CopiedFiles{
 		Copied:   []string{},
 		Checksum: make(map[string]string),
 	}
-	if _, err := os.Stat(from); err != nil && os.IsNotExist(err) {
-		return ret, nil
+	plan, err := hostFilesPlan(from, to, container)
+	if err != nil || len(plan) == 0 {
+		return ret, err
 	}
 	selinuxCtx, err := makeSELinuxCtx()
 	if err != nil {
@@ -459,44 +652,31 @@ func copyFilesToHost(from string, to string, container *Container) (*CopiedFiles
 		templates[v] = v
 	}
 
-	err = filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		rel, err := filepath.Rel(from, path)
-		if err != nil {
-			return err
-		}
-		dest := filepath.Join(to, rel)
-		canonicalName := fmt.Sprintf("/%s", rel)
-		if r, ok := container.RenameInstalledFiles[canonicalName]; ok {
-			dest = r
-		}
+	for _, f := range plan {
+		dest := m.underRoot(f.Installed)
 
 		if _, err := os.Stat(dest); err == nil {
-			return nil
+			continue
 		}
 
-		if _, ok := templates[canonicalName]; ok {
-			if err := TemplateWithDefaultGenerate(path, dest, "", container.values); err != nil {
-				return err
+		if _, ok := templates[f.Name]; ok {
+			if err := TemplateWithDefaultGenerate(f.Source, dest, "", container.values); err != nil {
+				return ret, err
 			}
 		} else {
-			if err := copyFileAndRelabel(selinuxCtx, path, dest); err != nil {
-				return err
+			if err := copyFileAndRelabel(selinuxCtx, f.Source, dest); err != nil {
+				return ret, err
 			}
 		}
 
 		checksum, err := getFileChecksum(dest)
 		if err != nil {
-			return err
+			return ret, err
 		}
 
-		ret.Copied = append(ret.Copied, dest)
-		ret.Checksum[dest] = checksum
-		log.Println(fmt.Sprintf("copied %s", dest))
-
-		return nil
-	})
-	return ret, err
+		ret.Copied = append(ret.Copied, f.Installed)
+		ret.Checksum[f.Installed] = checksum
+		m.logger.Println(fmt.Sprintf("copied %s", dest))
+	}
+	return ret, nil
 }
@@ -0,0 +1,105 @@
+package oscontainers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+const systemConfigFile = "/etc/containers/os-containers.conf"
+
+type storageConfig struct {
+	Repo      string `toml:"repo"`
+	Checkouts string `toml:"checkouts"`
+	Units     string `toml:"units"`
+	TmpFiles  string `toml:"tmpfiles"`
+	Layers    string `toml:"layers"`
+	Volumes   string `toml:"volumes"`
+	Secrets   string `toml:"secrets"`
+}
+
+type registriesConfig struct {
+	Insecure []string `toml:"insecure"`
+}
+
+type deploymentsConfig struct {
+	KeepPrevious bool `toml:"keep_previous"`
+	Overlay      bool `toml:"overlay"`
+}
+
+// config is the content of os-containers.conf.
+type config struct {
+	Runtime         string                    `toml:"runtime"`
+	SignaturePolicy string                    `toml:"signature_policy"`
+	AdminPolicy     string                    `toml:"admin_policy"`
+	Storage         storageConfig             `toml:"storage"`
+	Runtimes        map[string]RuntimeProfile `toml:"runtimes"`
+	Registries      registriesConfig          `toml:"registries"`
+	Values          map[string]string         `toml:"values"`
+	Deployments     deploymentsConfig         `toml:"deployments"`
+}
+
+func getUserConfigFile(configHome string) string {
+	return filepath.Join(configHome, "containers/os-containers.conf")
+}
+
+func setIfNotEmpty(dest *string, value string) {
+	if value != "" {
+		*dest = value
+	}
+}
+
+// readConfigFile applies the settings of a configuration file to opts.
+// The storage paths and the overlay deployments are ignored when
+// storage is false, so that the system file does not apply them to
+// rootless users.  A missing file is not an error.
+func readConfigFile(path string, opts *Options, storage bool) error {
+	var conf config
+	meta, err := toml.DecodeFile(path, &conf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "read %s", path)
+	}
+
+	if storage {
+		setIfNotEmpty(&opts.RepoPath, conf.Storage.Repo)
+		setIfNotEmpty(&opts.CheckoutsPath, conf.Storage.Checkouts)
+		setIfNotEmpty(&opts.UnitsPath, conf.Storage.Units)
+		setIfNotEmpty(&opts.TmpFilesPath, conf.Storage.TmpFiles)
+		setIfNotEmpty(&opts.LayersPath, conf.Storage.Layers)
+		setIfNotEmpty(&opts.VolumesPath, conf.Storage.Volumes)
+		setIfNotEmpty(&opts.SecretsPath, conf.Storage.Secrets)
+	}
+	setIfNotEmpty(&opts.Runtime, conf.Runtime)
+	setIfNotEmpty(&opts.SignaturePolicy, conf.SignaturePolicy)
+	setIfNotEmpty(&opts.AdminPolicy, conf.AdminPolicy)
+
+	for name, profile := range conf.Runtimes {
+		if profile.Path == "" {
+			return fmt.Errorf("%s: no path specified for the runtime %s", path, name)
+		}
+		if opts.Runtimes == nil {
+			opts.Runtimes = make(map[string]RuntimeProfile)
+		}
+		opts.Runtimes[name] = profile
+	}
+	opts.InsecureRegistries = append(opts.InsecureRegistries, conf.Registries.Insecure...)
+	for k, v := range conf.Values {
+		if opts.DefaultValues == nil {
+			opts.DefaultValues = make(map[string]string)
+		}
+		opts.DefaultValues[k] = v
+	}
+	if meta.IsDefined("deployments", "keep_previous") {
+		opts.DiscardPreviousDeployment = !conf.Deployments.KeepPrevious
+	}
+	if storage && meta.IsDefined("deployments", "overlay") {
+		opts.OverlayDeployments = conf.Deployments.Overlay
+	}
+	return nil
+}
@@ -5,6 +5,16 @@ import (
 	"io/ioutil"
 )
 
+// ContainerVolume is a persistent volume declared by an image.  Owner
+// is in the UID:GID form and Mode is octal.
+type ContainerVolume struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Owner       string `json:"owner,omitempty"`
+	Mode        string `json:"mode,omitempty"`
+	SELinuxType string `json:"selinuxType,omitempty"`
+}
+
 type ContainerManifest struct {
 	Version                string            `json:"string"`
 	DefaultValues          map[string]string `json:"defaultValues"`
@@ -12,6 +22,9 @@ type ContainerManifest struct {
 	NoContainerService     bool              `json:"noContainerService"`
 	UseLinks               bool              `json:"useLinks"`
 	InstalledFilesTemplate []string          `json:"installedFilesTemplate"`
+	StateDirectories       []string          `json:"stateDirectories"`
+	Volumes                []ContainerVolume `json:"volumes"`
+	Secrets                []string          `json:"secrets"`
 }
 
 func ReadContainerManifest(path string) (*ContainerManifest, error) {
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
@@ -24,10 +23,6 @@ const (
 	Failed
 )
 
-type Context struct {
-	Runtime string
-}
-
 type Container struct {
 	Name                   string                 `json:"-"`
 	OstreeCommit           string                 `json:"ostree-commit"`
@@ -41,7 +36,16 @@ type Container struct {
 	InstalledFilesTemplate []string               `json:"installed-files-template"`
 	InstalledFilesChecksum map[string]string      `json:"installed-files-checksum"`
 	RenameInstalledFiles   map[string]string      `json:"rename-installed-files"`
+	StateDirectories       []string               `json:"state-directories"`
 	Values                 map[string]interface{} `json:"values"`
+	SetValues              []string               `json:"set-values,omitempty"`
+	Overlay                bool                   `json:"overlay,omitempty"`
+	Layers                 []string               `json:"layers,omitempty"`
+	Volumes                []ContainerVolume      `json:"volumes,omitempty"`
+	Secrets                []string               `json:"secrets,omitempty"`
+	SecurityOpts           []string               `json:"security-opts,omitempty"`
+	ProcessLabel           string                 `json:"process-label,omitempty"`
+	MountLabel             string                 `json:"mount-label,omitempty"`
 
 	// Old info files have the map[string]interface{}, keep
 	// also the string->string version to avoid converting back
@@ -54,11 +58,14 @@ func GetContainerStatusString(s int) string {
 	return status[s]
 }
 
-func (c *Container) ContainerStatus() (int, error) {
-	if _, err := systemctlCommand("is-active", c.Name, false, true); err == nil {
+func (m *Manager) ContainerStatus(c *Container) (int, error) {
+	if m.root != "" {
+		return Stopped, nil
+	}
+	if _, err := m.systemctlCommand("is-active", c.Name, false, true); err == nil {
 		return Running, nil
 	}
-	if _, err := systemctlCommand("is-failed", c.Name, false, true); err == nil {
+	if _, err := m.systemctlCommand("is-failed", c.Name, false, true); err == nil {
 		return Failed, nil
 	}
 	return Stopped, nil
@@ -93,9 +100,9 @@ func ReadContainer(checkouts string, name string, deployment *int) (*Container,
 
 	subdir := name
 	if deployment != nil {
-		subdir = fmt.Sprintf("%s.%d", subdir, deployment)
+		subdir = fmt.Sprintf("%s.%d", subdir, *deployment)
 	}
-	info, err := ioutil.ReadFile(filepath.Join(checkouts, name, "info"))
+	info, err := ioutil.ReadFile(filepath.Join(checkouts, subdir, "info"))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, errors.Wrapf(err, "cannot find container %s", name)
@@ -109,9 +116,13 @@ func ReadContainer(checkouts string, name string, deployment *int) (*Container,
 	return &container, nil
 }
 
-func systemctlCommand(cmd string, name string, now bool, quiet bool) ([]byte, error) {
+func (m *Manager) GetContainer(name string) (*Container, error) {
+	return ReadContainer(m.checkoutsPath, name, nil)
+}
+
+func (m *Manager) systemctlCommand(cmd string, name string, now bool, quiet bool) ([]byte, error) {
 	var args []string
-	if os.Geteuid() != 0 {
+	if m.rootless {
 		args = append(args, "--user")
 	}
 	if now {
@@ -122,20 +133,118 @@ func systemctlCommand(cmd string, name string, now bool, quiet bool) ([]byte, er
 		args = append(args, name)
 	}
 	if !quiet {
-		log.Println(fmt.Sprintf("systemctl %s", strings.Join(args, " ")))
+		m.logger.Println(fmt.Sprintf("systemctl %s", strings.Join(args, " ")))
 	}
-	c := exec.Command("systemctl", args...)
+	c := exec.CommandContext(m.ctx, "systemctl", args...)
 
 	b, err := c.CombinedOutput()
 	if err != nil {
-		return nil, errors.Wrapf(err, "cannot execute systemctl")
+		return b, errors.Wrapf(err, "cannot execute systemctl")
 	}
 	return b, nil
 }
 
-func systemdTmpFilesCommand(cmd string, name string, quiet bool) ([]byte, error) {
+func (m *Manager) isUnitActive(name string) bool {
+	if m.root != "" {
+		return false
+	}
+	_, err := m.systemctlCommand("is-active", name, false, true)
+	return err == nil
+}
+
+// getUnitInstallDirectories returns the .wants and .requires
+// directories for the WantedBy= and RequiredBy= targets of the unit.
+func getUnitInstallDirectories(unitFile string) ([]string, error) {
+	data, err := ioutil.ReadFile(unitFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", unitFile)
+	}
+	var ret []string
+	section := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		if section != "[Install]" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var suffix string
+		switch strings.TrimSpace(kv[0]) {
+		case "WantedBy":
+			suffix = "wants"
+		case "RequiredBy":
+			suffix = "requires"
+		default:
+			continue
+		}
+		for _, target := range strings.Fields(kv[1]) {
+			ret = append(ret, fmt.Sprintf("%s.%s", target, suffix))
+		}
+	}
+	return ret, nil
+}
+
+func (m *Manager) enableUnit(name string, now bool) error {
+	return m.enableUnitFile(fmt.Sprintf("%s.service", name), now)
+}
+
+func (m *Manager) enableUnitFile(unit string, now bool) error {
+	if m.root == "" {
+		_, err := m.systemctlCommand("enable", unit, now, false)
+		return err
+	}
+
+	unitFile := filepath.Join(m.unitsPath, unit)
+	dirs, err := getUnitInstallDirectories(unitFile)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		dir := filepath.Join(m.unitsPath, d)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "create %s", dir)
+		}
+		link := filepath.Join(dir, unit)
+		os.Remove(link)
+		if err := os.Symlink(m.stripRoot(unitFile), link); err != nil {
+			return errors.Wrapf(err, "create symlink %s", link)
+		}
+		m.logger.Printf("created symlink %s", link)
+	}
+	return nil
+}
+
+func (m *Manager) disableUnit(name string) {
+	m.disableUnitFile(fmt.Sprintf("%s.service", name))
+}
+
+func (m *Manager) disableUnitFile(unit string) {
+	if m.root == "" {
+		m.systemctlCommand("disable", unit, true, false)
+		return
+	}
+
+	links, _ := filepath.Glob(filepath.Join(m.unitsPath, "*", unit))
+	for _, link := range links {
+		dir := filepath.Base(filepath.Dir(link))
+		if !strings.HasSuffix(dir, ".wants") && !strings.HasSuffix(dir, ".requires") {
+			continue
+		}
+		if err := os.Remove(link); err == nil {
+			m.logger.Printf("removed symlink %s", link)
+		}
+	}
+}
+
+func (m *Manager) systemdTmpFilesCommand(cmd string, name string, quiet bool) ([]byte, error) {
 	var args []string
-	if os.Geteuid() != 0 {
+	if m.rootless {
 		args = append(args, "--user")
 	}
 	args = append(args, cmd)
@@ -143,9 +252,9 @@ func systemdTmpFilesCommand(cmd string, name string, quiet bool) ([]byte, error)
 		args = append(args, name)
 	}
 	if !quiet {
-		log.Println(fmt.Sprintf("systemd-tmpfiles %s", strings.Join(args, " ")))
+		m.logger.Println(fmt.Sprintf("systemd-tmpfiles %s", strings.Join(args, " ")))
 	}
-	c := exec.Command("systemd-tmpfiles", args...)
+	c := exec.CommandContext(m.ctx, "systemd-tmpfiles", args...)
 	b, err := c.CombinedOutput()
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot execute systemd-tmpfiles")
@@ -153,8 +262,8 @@ func systemdTmpFilesCommand(cmd string, name string, quiet bool) ([]byte, error)
 	return b, nil
 }
 
-func GetContainers(all bool) ([]Container, error) {
-	checkouts := getCheckoutsDirectory()
+func (m *Manager) List() ([]Container, error) {
+	checkouts := m.checkoutsPath
 	files, err := ioutil.ReadDir(checkouts)
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot read checkouts from %s", checkouts)
@@ -172,37 +281,68 @@ func GetContainers(all bool) ([]Container, error) {
 	return containers, nil
 }
 
-func getCheckoutsDirectory() string {
-	e := os.Getenv("OS_CONTAINERS_CHECKOUT_PATH")
-	if e != "" {
-		return e
-	}
+type OutdatedContainer struct {
+	Name           string
+	Image          string
+	Revision       string
+	LocalRevision  string
+	RemoteRevision string
+}
 
-	if os.Geteuid() == 0 {
-		return "/var/lib/containers/atomic"
-	} else {
-		dataDir := os.Getenv("XDG_DATA_HOME")
-		if dataDir == "" {
-			home := os.Getenv("HOME")
-			resolvedHome, err := filepath.EvalSymlinks(home)
-			if err == nil {
-				home = resolvedHome
-			}
-			dataDir = filepath.Join(home, ".local", "share")
-		}
-		return filepath.Join(dataDir, "containers/atomic")
-	}
+func (o *OutdatedContainer) HasLocalUpdate() bool {
+	return o.LocalRevision != "" && o.LocalRevision != o.Revision
 }
 
-func getRuntime(ctx *Context) string {
-	if ctx != nil && ctx.Runtime != "" {
-		return ctx.Runtime
+func (o *OutdatedContainer) HasRemoteUpdate() bool {
+	return o.RemoteRevision != "" && o.RemoteRevision != o.Revision && o.RemoteRevision != o.LocalRevision
+}
+
+func (m *Manager) Outdated(remote, insecure bool) ([]OutdatedContainer, error) {
+	containers, err := m.List()
+	if err != nil {
+		return nil, err
 	}
-	runtime := os.Getenv("RUNTIME")
-	if runtime != "" {
-		return runtime
+
+	repoPath := m.repoPath
+	if _, err := os.Stat(repoPath); err != nil {
+		return nil, errors.Wrapf(err, "stat %s", repoPath)
 	}
-	return "/usr/bin/runc"
+	repo, err := openRepo(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []OutdatedContainer{}
+	for _, c := range containers {
+		o := OutdatedContainer{
+			Name:     c.Name,
+			Image:    c.Image,
+			Revision: c.Revision,
+		}
+
+		srcRef, err := parseImageName(c.Image)
+		if err != nil {
+			return nil, err
+		}
+		dockerRef := srcRef.DockerReference()
+		branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(dockerRef.String()))
+
+		found, imageID, err := repo.readMetadata(branch, "docker.digest")
+		if err == nil && found {
+			o.LocalRevision = strings.TrimPrefix(imageID, "sha256:")
+		}
+
+		if remote {
+			remoteID, err := m.getRemoteImageDigest(c.Image, insecure)
+			if err != nil {
+				m.logger.Printf("cannot check %s for updates: %v\n", c.Image, err)
+			} else {
+				o.RemoteRevision = remoteID
+			}
+		}
+		ret = append(ret, o)
+	}
+	return ret, nil
 }
 
 func deleteCheckouts(name string, checkouts string) error {
@@ -213,7 +353,7 @@ func deleteCheckouts(name string, checkouts string) error {
 		if _, err := os.Stat(checkout); err != nil {
 			break
 		}
-		err2 := os.RemoveAll(checkout)
+		err2 := removeDeployment(checkout)
 		if err2 != nil {
 			err = err2
 		}
@@ -222,7 +362,7 @@ func deleteCheckouts(name string, checkouts string) error {
 	return errors.Wrapf(err, "delete checkouts")
 }
 
-func destroyActiveCheckout(c *Container, checkouts string) error {
+func (m *Manager) destroyActiveCheckout(c *Container, checkouts string) error {
 	from := filepath.Join(checkouts, c.Name)
 	fi, err := os.Lstat(from)
 	if err != nil {
@@ -232,34 +372,44 @@ func destroyActiveCheckout(c *Container, checkouts string) error {
 		return fmt.Errorf("%s is not a symbolic link", from)
 	}
 	if c.HasContainerService {
-		systemctlCommand("disable", c.Name, true, false)
+		m.disableUnit(c.Name)
 		filename := fmt.Sprintf("%s.service", c.Name)
-		unitFile := filepath.Join(getSystemdDestination(), filename)
+		unitFile := filepath.Join(m.unitsPath, filename)
 		os.Remove(unitFile)
+		m.removeSecretsDropIn(c.Name)
 
 		_, err := os.Stat(filepath.Join(from, "rootfs/exports/tmpfiles.template"))
 		if err == nil {
 			filename := fmt.Sprintf("%s.conf", c.Name)
-			tmpFiles := filepath.Join(getSystemdTmpFilesDestination(), filename)
-			systemdTmpFilesCommand("--delete", tmpFiles, false)
+			tmpFiles := filepath.Join(m.tmpFilesPath, filename)
+			if m.root == "" {
+				m.systemdTmpFilesCommand("--delete", tmpFiles, false)
+			}
 			os.Remove(tmpFiles)
 		}
 	}
+	if c.Overlay {
+		target, err := filepath.EvalSymlinks(from)
+		if err != nil {
+			return err
+		}
+		m.deactivateOverlay(c, target)
+	}
 	for _, f := range c.InstalledFiles {
 		oldChecksum := c.InstalledFilesChecksum[f]
-		newChecksum, err := getFileChecksum(f)
+		newChecksum, err := getFileChecksum(m.underRoot(f))
 		if err != nil {
 			continue
 		}
 		/* The file was not modified since its installation.  */
 		if newChecksum != oldChecksum {
-			log.Printf("file %s was modified.  Skip.\n", f)
+			m.logger.Printf("file %s was modified.  Skip.\n", f)
 		} else {
-			err = os.Remove(f)
+			err = os.Remove(m.underRoot(f))
 			if err != nil {
-				log.Printf("could not delete %s: %v\n", f, err)
+				m.logger.Printf("could not delete %s: %v\n", f, err)
 			} else {
-				log.Printf("file %s deleted\n", f)
+				m.logger.Printf("file %s deleted\n", f)
 			}
 		}
 	}
@@ -272,11 +422,11 @@ func isStdinTTY() bool {
 	return C.isatty(1) != 0
 }
 
-func RunCommand(container string, command []string, set map[string]string, ctx *Context) error {
-	checkouts := getCheckoutsDirectory()
+func (m *Manager) Run(container string, command []string, set map[string]string) error {
+	checkouts := m.checkoutsPath
 
 	if _, err := os.Stat(filepath.Join(checkouts, container)); err != nil && os.IsNotExist(err) {
-		return runCommandFromImage(container, command, set, ctx)
+		return m.runCommandFromImage(container, command, set)
 	}
 
 	if len(set) > 0 {
@@ -288,14 +438,18 @@ func RunCommand(container string, command []string, set map[string]string, ctx *
 		return err
 	}
 
-	s, err := c.ContainerStatus()
+	s, err := m.ContainerStatus(c)
 	if err != nil {
 		return err
 	}
 
 	if s != Running {
-		return runCommandInBundle(c, checkouts, command)
-		return fmt.Errorf("%s is not running", container)
+		return m.runCommandInBundle(c, checkouts, command, c.Name)
+	}
+
+	profile, err := m.runtimeProfile(c.Runtime)
+	if err != nil {
+		return err
 	}
 
 	var args []string
@@ -304,21 +458,25 @@ func RunCommand(container string, command []string, set map[string]string, ctx *
 	} else {
 		args = append([]string{"exec", container}, command...)
 	}
-	cmd := exec.Command(c.Runtime, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	return cmd.Run()
+	cmd := m.runtimeExec(profile, args...)
+	return m.runWithJournal(cmd, c.Name)
+}
+
+func (m *Manager) runCommandInBundle(c *Container, checkouts string, args []string, identifier string) error {
+	return m.runInDeployment(c, filepath.Join(checkouts, c.Name), args, nil, isStdinTTY(), identifier)
 }
 
-func runCommandInBundle(c *Container, checkouts string, args []string) error {
+// runInDeployment runs args in a new container that uses the
+// configuration and the rootfs of the deployment in deployDir, with env
+// added to the environment of the process.
+func (m *Manager) runInDeployment(c *Container, deployDir string, args, env []string, terminal bool, identifier string) error {
 	bundleDir, err := ioutil.TempDir("", "os-container")
 	if err != nil {
 		return errors.Wrapf(err, "create temporary bundle directory")
 	}
 	defer os.RemoveAll(bundleDir)
 
-	originConfig := filepath.Join(checkouts, c.Name, "config.json")
+	originConfig := filepath.Join(deployDir, "config.json")
 
 	var config map[string]interface{}
 
@@ -330,13 +488,21 @@ func runCommandInBundle(c *Container, checkouts string, args []string) error {
 		return errors.Wrapf(err, "unmarshal JSON %s", originConfig)
 	}
 
-	rootfs, err := filepath.EvalSymlinks(filepath.Join(checkouts, c.Name, "rootfs"))
+	rootfs, err := filepath.EvalSymlinks(filepath.Join(deployDir, "rootfs"))
 	if err != nil {
 		return errors.Wrapf(err, "evaluate symlink to rootfs")
 	}
 
-	config["process"].(map[string]interface{})["args"] = args
-	config["process"].(map[string]interface{})["terminal"] = isStdinTTY()
+	process := config["process"].(map[string]interface{})
+	process["args"] = args
+	process["terminal"] = terminal
+	if len(env) > 0 {
+		processEnv, _ := process["env"].([]interface{})
+		for _, e := range env {
+			processEnv = append(processEnv, e)
+		}
+		process["env"] = processEnv
+	}
 	config["root"].(map[string]interface{})["path"] = rootfs
 
 	newConfig, err := json.Marshal(&config)
@@ -349,22 +515,27 @@ func runCommandInBundle(c *Container, checkouts string, args []string) error {
 		return errors.Wrapf(err, "write config.json")
 	}
 
-	tmpFiles := filepath.Join(checkouts, c.Name, fmt.Sprintf("tmpfiles-%s.conf", c.Name))
+	tmpFiles := filepath.Join(deployDir, fmt.Sprintf("tmpfiles-%s.conf", c.Name))
 	if _, err := os.Stat(tmpFiles); err == nil {
-		if _, err := systemdTmpFilesCommand("--create", tmpFiles, true); err != nil {
+		if _, err := m.systemdTmpFilesCommand("--create", tmpFiles, true); err != nil {
 			return err
 		}
 	}
 
-	cmd := exec.Command(c.Runtime, "run", path.Base(bundleDir))
+	profile, err := m.runtimeProfile(c.Runtime)
+	if err != nil {
+		return err
+	}
+	cmd := m.runtimeExec(profile, "run", path.Base(bundleDir))
 	cmd.Dir = bundleDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	return cmd.Run()
+	return m.runWithJournal(cmd, identifier)
 }
 
-func runCommandFromImage(image string, command []string, set map[string]string, ctx *Context) error {
+func (m *Manager) runCommandFromImage(image string, command []string, set map[string]string) error {
+	image, err := m.resolveImageName(image)
+	if err != nil {
+		return err
+	}
 	srcRef, err := parseImageName(image)
 	if err != nil {
 		return err
@@ -372,13 +543,13 @@ func runCommandFromImage(image string, command []string, set map[string]string,
 	dockerRef := srcRef.DockerReference()
 	branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(dockerRef.String()))
 
-	tmpCheckouts, err := ioutil.TempDir(filepath.Join(getOSTreeRepo(), "tmp"), "os-container")
+	tmpCheckouts, err := ioutil.TempDir(filepath.Join(m.repoPath, "tmp"), "os-container")
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(tmpCheckouts)
 
-	repoPath := getOSTreeRepo()
+	repoPath := m.repoPath
 
 	repo, err := openRepo(repoPath)
 	if err != nil {
@@ -390,7 +561,13 @@ func runCommandFromImage(image string, command []string, set map[string]string,
 		return err
 	}
 
-	ctr, err := checkoutContainerTo(branch, repo, tmpCheckouts, set, "tmp", image, imageID, 0, ctx)
+	/* The temporary checkout is not mounted, so it can be deleted,
+	   and its volumes are deleted with it.  */
+	tmp := *m.withOverlay(false)
+	tmp.volumesPath = filepath.Join(tmpCheckouts, "volumes")
+	tmp.secretsPath = filepath.Join(tmpCheckouts, "secrets")
+	tmp.apparmorPath = filepath.Join(tmpCheckouts, "apparmor")
+	ctr, err := tmp.checkoutContainerTo(branch, repo, tmpCheckouts, set, "tmp", image, imageID, 0)
 	if err != nil {
 		return err
 	}
@@ -403,5 +580,5 @@ func runCommandFromImage(image string, command []string, set map[string]string,
 		return fmt.Errorf("the image %s cannot be used without a container as it exports files to the host", image)
 	}
 
-	return runCommandInBundle(ctr, tmpCheckouts, command)
+	return m.runCommandInBundle(ctr, tmpCheckouts, command, getDefaultContainerName(dockerRef))
 }
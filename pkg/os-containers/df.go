@@ -0,0 +1,255 @@
+package oscontainers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+type LayerDiskUsage struct {
+	Digest string
+	Size   uint64
+	// Unique is the space used only by this layer.
+	Unique uint64
+}
+
+type ImageDiskUsage struct {
+	Name    string
+	ImageID string
+	Size    uint64
+	// Unique is the space used only by this image, Shared is the
+	// space used by objects that other images use as well.
+	Unique uint64
+	Shared uint64
+	Layers []LayerDiskUsage
+}
+
+type DeploymentDiskUsage struct {
+	Deployment int
+	Active     bool
+	Size       uint64
+	// Exclusive is the space used by the files that are not
+	// hard links to the OSTree repository.
+	Exclusive uint64
+}
+
+type ContainerDiskUsage struct {
+	Name        string
+	Deployments []DeploymentDiskUsage
+}
+
+type DiskUsage struct {
+	RepoSize   uint64
+	Images     []ImageDiskUsage
+	Containers []ContainerDiskUsage
+	// Reclaimable is the space freed by images prune.
+	Reclaimable uint64
+}
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// directorySize returns the size of the files under path, counting
+// hard links only once.  Mount points, such as the rootfs of overlay
+// deployments, are skipped.
+func directorySize(path string, seen map[inodeKey]bool) (size, exclusive uint64, err error) {
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && p != path && isMountPoint(p) {
+			return filepath.SkipDir
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || info.IsDir() {
+			return nil
+		}
+		key := inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		size += uint64(info.Size())
+		if st.Nlink == 1 {
+			exclusive += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, exclusive, err
+}
+
+func (m *Manager) deploymentsDiskUsage(name string) ([]DeploymentDiskUsage, error) {
+	active, _ := getCurrentRevision(filepath.Join(m.checkoutsPath, name))
+
+	matches, err := filepath.Glob(filepath.Join(m.checkoutsPath, name+".*"))
+	if err != nil {
+		return nil, err
+	}
+	var ret []DeploymentDiskUsage
+	for _, d := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(d), name+"."))
+		if err != nil {
+			continue
+		}
+		size, exclusive, err := directorySize(d, make(map[inodeKey]bool))
+		if err != nil {
+			return nil, errors.Wrapf(err, "compute the size of %s", d)
+		}
+		ret = append(ret, DeploymentDiskUsage{
+			Deployment: n,
+			Active:     n == active,
+			Size:       size,
+			Exclusive:  exclusive,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Deployment < ret[j].Deployment
+	})
+	return ret, nil
+}
+
+func (m *Manager) DiskUsage() (*DiskUsage, error) {
+	if _, err := os.Stat(m.repoPath); err != nil {
+		return nil, err
+	}
+	repo, err := openRepo(m.repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &DiskUsage{}
+	repoSize, _, err := directorySize(filepath.Join(m.repoPath, "objects"), make(map[inodeKey]bool))
+	if err != nil {
+		return nil, errors.Wrapf(err, "compute the size of %s", m.repoPath)
+	}
+	ret.RepoSize = repoSize
+
+	images, err := getImages(repo, false)
+	if err != nil {
+		return nil, err
+	}
+
+	objectSizes := make(map[string]uint64)
+	layerObjects := make(map[string]map[string]uint64)
+	readObjects := func(branch string) (map[string]uint64, error) {
+		commit, err := repo.resolveCommit(branch)
+		if err != nil {
+			return nil, err
+		}
+		objects, err := repo.reachableObjects(commit)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read the objects of %s", branch)
+		}
+		for k, v := range objects {
+			objectSizes[k] = v
+		}
+		return objects, nil
+	}
+
+	imageObjects := make([]map[string]bool, len(images))
+	imageLayers := make([][]string, len(images))
+	imageUsers := make(map[string]int)
+	layerUsers := make(map[string]int)
+	for i, img := range images {
+		objects, err := readObjects(img.OSTreeBranch)
+		if err != nil {
+			return nil, err
+		}
+		imageObjects[i] = make(map[string]bool)
+		for k := range objects {
+			imageObjects[i][k] = true
+		}
+
+		_, manifest, err := repo.readMetadata(img.OSTreeBranch, "docker.manifest")
+		if err != nil {
+			return nil, err
+		}
+		layers, err := getLayers([]byte(manifest))
+		if err != nil {
+			return nil, errors.Wrapf(err, "read layers of %s", img.Name)
+		}
+		for _, l := range layers {
+			if _, ok := layerObjects[l]; !ok {
+				objects, err := readObjects(fmt.Sprintf("%s/%s", ostreePrefix, l))
+				if err != nil {
+					return nil, err
+				}
+				layerObjects[l] = objects
+				for k := range objects {
+					layerUsers[k]++
+				}
+			}
+			for k := range layerObjects[l] {
+				imageObjects[i][k] = true
+			}
+		}
+		imageLayers[i] = layers
+		for k := range imageObjects[i] {
+			imageUsers[k]++
+		}
+	}
+
+	var reachable uint64
+	for k := range imageUsers {
+		reachable += objectSizes[k]
+	}
+	if repoSize > reachable {
+		ret.Reclaimable = repoSize - reachable
+	}
+
+	for i, img := range images {
+		usage := ImageDiskUsage{
+			Name:    img.Name,
+			ImageID: img.ImageID,
+		}
+		for k := range imageObjects[i] {
+			usage.Size += objectSizes[k]
+			if imageUsers[k] == 1 {
+				usage.Unique += objectSizes[k]
+			} else {
+				usage.Shared += objectSizes[k]
+			}
+		}
+		for _, l := range imageLayers[i] {
+			layer := LayerDiskUsage{Digest: l}
+			for k, size := range layerObjects[l] {
+				layer.Size += size
+				if layerUsers[k] == 1 {
+					layer.Unique += size
+				}
+			}
+			usage.Layers = append(usage.Layers, layer)
+		}
+		ret.Images = append(ret.Images, usage)
+	}
+	sort.Slice(ret.Images, func(i, j int) bool {
+		return ret.Images[i].Name < ret.Images[j].Name
+	})
+
+	containers, err := m.List()
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+	for _, c := range containers {
+		deployments, err := m.deploymentsDiskUsage(c.Name)
+		if err != nil {
+			return nil, err
+		}
+		ret.Containers = append(ret.Containers, ContainerDiskUsage{
+			Name:        c.Name,
+			Deployments: deployments,
+		})
+	}
+	return ret, nil
+}
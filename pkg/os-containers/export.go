@@ -0,0 +1,422 @@
+package oscontainers
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containers/image/copy"
+	"github.com/containers/image/transports/alltransports"
+	"github.com/pkg/errors"
+)
+
+const (
+	exportInfoName  = "container.json"
+	exportImageName = "image.tar"
+	exportFilesDir  = "files"
+	exportStateDir  = "state"
+)
+
+type containerExport struct {
+	Name             string                 `json:"name"`
+	Image            string                 `json:"image"`
+	ImageID          string                 `json:"image-id"`
+	Runtime          string                 `json:"runtime"`
+	SecurityOpts     []string               `json:"security-opts,omitempty"`
+	Values           map[string]interface{} `json:"values"`
+	ModifiedFiles    []string               `json:"modified-files"`
+	StateDirectories []string               `json:"state-directories"`
+	HasImage         bool                   `json:"has-image"`
+}
+
+func addToTar(tw *tar.Writer, src, name string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return errors.Wrapf(err, "read link %s", path)
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errors.Wrapf(err, "create tar header for %s", path)
+		}
+		hdr.Name = filepath.Join(name, rel)
+		if info.IsDir() {
+			hdr.Name = hdr.Name + "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write tar header for %s", path)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "open %s", path)
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return errors.Wrapf(err, "write %s to the archive", path)
+		}
+		return nil
+	})
+}
+
+func (m *Manager) Export(name, output string, withImage bool) error {
+	checkouts := m.checkoutsPath
+
+	ctr, err := ReadContainer(checkouts, name, nil)
+	if err != nil {
+		return err
+	}
+
+	info := containerExport{
+		Name:          ctr.Name,
+		Image:         ctr.Image,
+		ImageID:       ctr.Revision,
+		Runtime:       ctr.Runtime,
+		SecurityOpts:  ctr.SecurityOpts,
+		Values:        ctr.Values,
+		ModifiedFiles: []string{},
+		HasImage:      withImage,
+	}
+	for _, f := range ctr.InstalledFiles {
+		checksum, err := getFileChecksum(m.underRoot(f))
+		if err != nil {
+			continue
+		}
+		if checksum != ctr.InstalledFilesChecksum[f] {
+			info.ModifiedFiles = append(info.ModifiedFiles, f)
+		}
+	}
+	for _, d := range ctr.StateDirectories {
+		if _, err := os.Stat(m.underRoot(d)); err != nil {
+			m.logger.Printf("state directory %s not found.  Skip.\n", d)
+			continue
+		}
+		info.StateDirectories = append(info.StateDirectories, d)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "os-container")
+	if err != nil {
+		return errors.Wrapf(err, "create temporary directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	infoFile := filepath.Join(tmpDir, exportInfoName)
+	infoData, err := json.Marshal(&info)
+	if err != nil {
+		return errors.Wrapf(err, "marshal JSON")
+	}
+	if err := ioutil.WriteFile(infoFile, infoData, 0600); err != nil {
+		return errors.Wrapf(err, "write %s", infoFile)
+	}
+
+	imageFile := filepath.Join(tmpDir, exportImageName)
+	if withImage {
+		if err := m.saveImageToArchive(ctr.Image, imageFile); err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", output)
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	err = func() error {
+		if err := addToTar(tw, infoFile, exportInfoName); err != nil {
+			return err
+		}
+		if withImage {
+			if err := addToTar(tw, imageFile, exportImageName); err != nil {
+				return err
+			}
+		}
+		for _, f := range info.ModifiedFiles {
+			if err := addToTar(tw, m.underRoot(f), filepath.Join(exportFilesDir, f)); err != nil {
+				return err
+			}
+			m.logger.Printf("exported %s\n", f)
+		}
+		for _, d := range info.StateDirectories {
+			if err := addToTar(tw, m.underRoot(d), filepath.Join(exportStateDir, d)); err != nil {
+				return err
+			}
+			m.logger.Printf("exported %s\n", d)
+		}
+		return tw.Close()
+	}()
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) saveImageToArchive(image, dest string) error {
+	srcRef, err := parseImageName(image)
+	if err != nil {
+		return err
+	}
+	dockerRef := srcRef.DockerReference()
+
+	ostreeRef, err := getOSTreeReference(srcRef, m.repoPath)
+	if err != nil {
+		return err
+	}
+	destRef, err := alltransports.ParseImageName(fmt.Sprintf("docker-archive:%s:%s", dest, dockerRef.String()))
+	if err != nil {
+		return err
+	}
+
+	policyContext, err := m.getPolicyContext()
+	if err != nil {
+		return err
+	}
+	defer policyContext.Destroy()
+
+	return copy.Image(m.ctx, policyContext, destRef, ostreeRef, &copy.Options{
+		ReportWriter: m.output,
+	})
+}
+
+func readContainerExport(input string) (*containerExport, error) {
+	var info *containerExport
+	err := walkTar(input, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name != exportInfoName {
+			return nil
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		info = &containerExport{}
+		return json.Unmarshal(data, info)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", input)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("%s is not a container archive", input)
+	}
+	return info, nil
+}
+
+func walkTar(input string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// computedValues are the template values that os-container sets for each
+// installation, they are not carried to the imported container.
+var computedValues = map[string]bool{
+	"NAME":          true,
+	"DESTDIR":       true,
+	"PIDFILE":       true,
+	"UUID":          true,
+	"HOST_UID":      true,
+	"HOST_GID":      true,
+	"IMAGE_NAME":    true,
+	"IMAGE_ID":      true,
+	"EXEC_START":    true,
+	"EXEC_STOP":     true,
+	"EXEC_STARTPRE": true,
+	"EXEC_STOPPOST": true,
+}
+
+func isPathUnder(path string, parents []string) bool {
+	for _, p := range parents {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) extractTarEntry(hdr *tar.Header, r io.Reader, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return errors.Wrapf(err, "create parent for %s", dest)
+	}
+	mode := os.FileMode(hdr.Mode) & os.ModePerm
+	/* Never write through what is already there, it may be a symlink
+	   restored from the archive.  */
+	if st, err := os.Lstat(dest); err == nil && (!st.IsDir() || hdr.Typeflag != tar.TypeDir) {
+		if err := os.Remove(dest); err != nil {
+			return errors.Wrapf(err, "remove %s", dest)
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(dest, mode); err != nil {
+			return errors.Wrapf(err, "create %s", dest)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, dest); err != nil {
+			return errors.Wrapf(err, "create symlink %s", dest)
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
+		if err != nil {
+			return errors.Wrapf(err, "open %s", dest)
+		}
+		defer f.Close()
+		if _, err := io.Copy(f, r); err != nil {
+			return errors.Wrapf(err, "write %s", dest)
+		}
+	default:
+		m.logger.Printf("unsupported file type for %s.  Skip.\n", dest)
+		return nil
+	}
+	if !m.rootless {
+		if err := os.Lchown(dest, hdr.Uid, hdr.Gid); err != nil {
+			return errors.Wrapf(err, "chown %s", dest)
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(dest, mode); err != nil {
+			return errors.Wrapf(err, "chmod %s", dest)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) Import(input, name, runtime string, confirm ConfirmFunc) error {
+	info, err := readContainerExport(input)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = info.Name
+	}
+	if runtime == "" {
+		runtime = info.Runtime
+	}
+
+	checkouts := m.checkoutsPath
+	if _, err := os.Stat(filepath.Join(checkouts, name)); err == nil {
+		return fmt.Errorf("the container %s already exists", name)
+	}
+
+	if info.HasImage {
+		tmpDir, err := ioutil.TempDir("", "os-container")
+		if err != nil {
+			return errors.Wrapf(err, "create temporary directory")
+		}
+		defer os.RemoveAll(tmpDir)
+
+		imageFile := filepath.Join(tmpDir, exportImageName)
+		err = walkTar(input, func(hdr *tar.Header, r io.Reader) error {
+			if hdr.Name != exportImageName {
+				return nil
+			}
+			return m.extractTarEntry(hdr, r, imageFile)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "read %s", input)
+		}
+		if err := m.Pull(false, fmt.Sprintf("docker-archive:%s", imageFile)); err != nil {
+			return err
+		}
+	}
+
+	set := make(map[string]string)
+	for k, v := range info.Values {
+		if !computedValues[k] {
+			set[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	if err := m.withRuntime(runtime).Install(name, info.Image, set, InstallOptions{SecurityOpts: info.SecurityOpts, Confirm: confirm}); err != nil {
+		return err
+	}
+
+	ctr, err := ReadContainer(checkouts, name, nil)
+	if err != nil {
+		return err
+	}
+	if ctr.Revision != info.ImageID {
+		m.logger.Printf("the image %s has changed since the export (%s, was %s)\n", info.Image, ctr.Revision, info.ImageID)
+	}
+
+	/* Only the files of the new installation are restored, whatever
+	   the archive lists.  */
+	return walkTar(input, func(hdr *tar.Header, r io.Reader) error {
+		var allowed []string
+		var path string
+		if strings.HasPrefix(hdr.Name, exportFilesDir+"/") {
+			allowed = ctr.InstalledFiles
+			path = strings.TrimPrefix(hdr.Name, exportFilesDir)
+		} else if strings.HasPrefix(hdr.Name, exportStateDir+"/") {
+			allowed = ctr.StateDirectories
+			path = strings.TrimPrefix(hdr.Name, exportStateDir)
+		} else {
+			return nil
+		}
+		path = filepath.Clean(path)
+		if !isPathUnder(path, allowed) {
+			return fmt.Errorf("the archive contains the unexpected file %s", hdr.Name)
+		}
+		dest := m.underRoot(path)
+		/* Do not follow symlinks that were restored from the archive.
+		   An absolute symlink resolves outside of an alternate root.  */
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(dest)); err == nil && parent != filepath.Dir(dest) {
+			if m.underRoot(m.stripRoot(parent)) != parent || !isPathUnder(m.stripRoot(parent), allowed) {
+				return fmt.Errorf("the archive entry %s points outside of %s", hdr.Name, strings.Join(allowed, ", "))
+			}
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			target := hdr.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			if !isPathUnder(filepath.Clean(target), allowed) {
+				return fmt.Errorf("the archive entry %s points outside of %s", hdr.Name, strings.Join(allowed, ", "))
+			}
+		}
+		if err := m.extractTarEntry(hdr, r, dest); err != nil {
+			return err
+		}
+		for _, p := range allowed {
+			if p == path {
+				m.logger.Printf("restored %s\n", path)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,95 @@
+package oscontainers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/opencontainers/selinux/go-selinux/label"
+	"github.com/pkg/errors"
+)
+
+// The hooks that an image can ship in exports/hooks.
+const (
+	preInstallHook   = "pre-install"
+	postInstallHook  = "post-install"
+	preUpdateHook    = "pre-update"
+	postUpdateHook   = "post-update"
+	preUninstallHook = "pre-uninstall"
+)
+
+// hookEnv returns the template values of a container as environment
+// variables.
+func hookEnv(c *Container) []string {
+	var env []string
+	for k, v := range c.Values {
+		env = append(env, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(env)
+	return env
+}
+
+// prepareHookSecrets copies the current secrets of a container to the
+// staging directory mounted in the container.  The directory may be
+// left by an older deployment, so the secrets are always copied again.
+func (m *Manager) prepareHookSecrets(c *Container) error {
+	if len(c.Secrets) == 0 {
+		return nil
+	}
+	staging := secretsStagingDir(fmt.Sprintf("%v", c.Values["RUN_DIRECTORY"]), c.Name)
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return errors.Wrapf(err, "create %s", staging)
+	}
+	for _, s := range c.Secrets {
+		data, err := ioutil.ReadFile(filepath.Join(m.secretsDir(c.Name), s))
+		if err != nil {
+			return errors.Wrapf(err, "read the secret %s", s)
+		}
+		if err := writeSecretFile(staging, s, data); err != nil {
+			return err
+		}
+	}
+	if c.MountLabel != "" {
+		return label.Relabel(staging, c.MountLabel, false)
+	}
+	return nil
+}
+
+// runHook runs the hook shipped by the image of the deployment in
+// deployDir, if any.  The hook runs in a new container with the
+// configuration of the deployment and the template values in its
+// environment.
+func (m *Manager) runHook(c *Container, deployDir, hook string) error {
+	if m.skipHooks {
+		return nil
+	}
+	rootfs := filepath.Join(deployDir, "rootfs")
+	hookPath := filepath.Join("/exports/hooks", hook)
+	st, err := os.Stat(filepath.Join(rootfs, hookPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "stat the hook %s", hook)
+	}
+	/* The configuration refers to the paths of the target system, the
+	   container cannot run in an alternate root.  */
+	if m.root != "" {
+		m.logger.Printf("the %s hook of %s is not run in an alternate root\n", hook, c.Name)
+		return nil
+	}
+	if st.Mode()&0111 == 0 {
+		return fmt.Errorf("the %s hook of the container %s is not executable", hook, c.Name)
+	}
+	if err := m.prepareHookSecrets(c); err != nil {
+		return err
+	}
+
+	m.logger.Printf("run the %s hook of %s\n", hook, c.Name)
+	if err := m.runInDeployment(c, deployDir, []string{hookPath}, hookEnv(c), false, c.Name); err != nil {
+		return errors.Wrapf(err, "the %s hook of the container %s failed", hook, c.Name)
+	}
+	return nil
+}
@@ -2,13 +2,14 @@ package oscontainers
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 
+	"github.com/containers/image/image"
+	"github.com/containers/image/manifest"
 	"github.com/containers/image/transports/alltransports"
 	"github.com/containers/image/types"
 	"github.com/pkg/errors"
@@ -23,10 +24,12 @@ type Image struct {
 	Intermediate bool
 	ImageID      string
 	Size         uint64
+	// Platform is empty for the images pulled by older versions.
+	Platform string
 }
 
-func GetImages(all bool) ([]Image, error) {
-	repoPath := getOSTreeRepo()
+func (m *Manager) Images(all bool) ([]Image, error) {
+	repoPath := m.repoPath
 
 	if _, err := os.Stat(repoPath); err != nil {
 		return nil, err
@@ -92,11 +95,13 @@ func getImages(repo *OSTreeRepo, all bool) ([]Image, error) {
 		name := decodeOStreeRef(k)
 
 		var size uint64
+		var platform string
 		if intermediate {
 			name = ""
 			size = sizes[k]
 		} else {
 			size, _ = computeImageSize(repo, branch, sizes)
+			_, platform, _ = repo.readMetadata(branch, platformMetadataKey)
 		}
 
 		imageID = strings.TrimPrefix(imageID, "sha256:")
@@ -108,6 +113,7 @@ func getImages(repo *OSTreeRepo, all bool) ([]Image, error) {
 			Intermediate: intermediate,
 			ImageID:      imageID,
 			Size:         size,
+			Platform:     platform,
 		}
 		ret = append(ret, i)
 	}
@@ -115,7 +121,11 @@ func getImages(repo *OSTreeRepo, all bool) ([]Image, error) {
 	return ret, nil
 }
 
-func DeleteImage(name string) error {
+func (m *Manager) DeleteImage(name string) error {
+	name, err := m.resolveImageName(name)
+	if err != nil {
+		return err
+	}
 	srcRef, err := parseImageName(name)
 	if err != nil {
 		return err
@@ -125,7 +135,7 @@ func DeleteImage(name string) error {
 
 	branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(dockerRef.String()))
 
-	repoPath := getOSTreeRepo()
+	repoPath := m.repoPath
 
 	if _, err := os.Stat(repoPath); err != nil {
 		return errors.Wrapf(err, "stat %s", repoPath)
@@ -137,11 +147,11 @@ func DeleteImage(name string) error {
 	return repo.deleteBranch(branch)
 }
 
-func PruneImages() error {
+func (m *Manager) PruneImages() error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	repoPath := getOSTreeRepo()
+	repoPath := m.repoPath
 
 	if _, err := os.Stat(repoPath); err != nil {
 		return errors.Wrapf(err, "stat %s", repoPath)
@@ -180,12 +190,12 @@ func PruneImages() error {
 		if i.Intermediate {
 			_, ok := seen[i.Name]
 			if ok {
-				log.Printf("layer %s: keep", i.Name)
+				m.logger.Printf("layer %s: keep", i.Name)
 			} else {
 				if err := repo.deleteBranch(i.OSTreeBranch); err != nil {
 					return err
 				}
-				log.Printf("layer %s: delete", i.Name)
+				m.logger.Printf("layer %s: delete", i.Name)
 			}
 		}
 	}
@@ -193,8 +203,8 @@ func PruneImages() error {
 	if err != nil {
 		return err
 	}
-	log.Printf("pruned %v bytes", size)
-	return nil
+	m.logger.Printf("pruned %v bytes", size)
+	return m.pruneLayerCache()
 }
 
 func parseImageName(image string) (types.ImageReference, error) {
@@ -205,7 +215,47 @@ func parseImageName(image string) (types.ImageReference, error) {
 	return srcRef, err
 }
 
-func TagImage(src, dest string) error {
+func (m *Manager) getRemoteImageDigest(name string, insecure bool) (string, error) {
+	srcRef, err := parseImageName(name)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := m.ctx
+	sys := &types.SystemContext{
+		DockerInsecureSkipTLSVerify: insecure || m.isInsecureRegistry(srcRef),
+	}
+	src, err := srcRef.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", errors.Wrapf(err, "open image %s", name)
+	}
+	defer src.Close()
+
+	blob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "read manifest for %s", name)
+	}
+
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		d, err := image.ChooseManifestInstanceFromManifestList(ctx, sys, image.UnparsedInstance(src, nil))
+		if err != nil {
+			return "", errors.Wrapf(err, "choose image from manifest list for %s", name)
+		}
+		return d.Hex(), nil
+	}
+
+	d, err := manifest.Digest(blob)
+	if err != nil {
+		return "", errors.Wrapf(err, "compute digest for %s", name)
+	}
+	return d.Hex(), nil
+}
+
+func (m *Manager) TagImage(src, dest string) error {
+	src, err := m.resolveImageName(src)
+	if err != nil {
+		return err
+	}
 	srcRef, err := parseImageName(src)
 	if err != nil {
 		return err
@@ -220,7 +270,7 @@ func TagImage(src, dest string) error {
 	dockerRef = destRef.DockerReference()
 	destBranch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(dockerRef.String()))
 
-	repoPath := getOSTreeRepo()
+	repoPath := m.repoPath
 	if _, err := os.Stat(repoPath); err != nil {
 		return errors.Wrapf(err, "stat %s", repoPath)
 	}
@@ -0,0 +1,360 @@
+package oscontainers
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var templateVariableRegex = regexp.MustCompile(`\$(\$|\{[^}]*\}|[A-Za-z_]+)`)
+
+/* Values set by os-containers for every container.  */
+var automaticValues = []string{
+	"NAME", "DESTDIR", "UUID", "HOST_UID", "HOST_GID", "IMAGE_NAME", "IMAGE_ID",
+	"RUN_DIRECTORY", "CONF_DIRECTORY", "STATE_DIRECTORY", "PIDFILE",
+	"EXEC_START", "EXEC_STOP", "EXEC_STARTPRE", "EXEC_STOPPOST",
+}
+
+type ImageLayer struct {
+	Digest           string `json:"digest"`
+	Size             int64  `json:"size"`
+	UncompressedSize uint64 `json:"uncompressedSize"`
+}
+
+// ImageVariable is a variable referenced by the templates of an image.
+// Default is the value from the image manifest.json, Automatic is set
+// for the values provided by os-containers.  A variable that is
+// neither defaulted nor automatic must be specified with --set.
+type ImageVariable struct {
+	Name      string   `json:"name"`
+	Default   *string  `json:"default,omitempty"`
+	Automatic bool     `json:"automatic"`
+	Required  bool     `json:"required"`
+	Files     []string `json:"files"`
+}
+
+type ImageInspection struct {
+	Name         string             `json:"name"`
+	ImageID      string             `json:"imageId"`
+	OSTreeBranch string             `json:"ostreeBranch"`
+	Created      *time.Time         `json:"created,omitempty"`
+	Architecture string             `json:"architecture"`
+	OS           string             `json:"os"`
+	Labels       map[string]string  `json:"labels"`
+	Layers       []ImageLayer       `json:"layers"`
+	Manifest     *ContainerManifest `json:"manifest,omitempty"`
+	HasService   bool               `json:"hasService"`
+	Variables    []ImageVariable    `json:"variables"`
+	HostFiles    []string           `json:"hostFiles"`
+}
+
+func templateVariables(data string) []string {
+	var ret []string
+	for _, match := range templateVariableRegex.FindAllStringSubmatch(data, -1) {
+		v := match[1]
+		if v == "$" {
+			continue
+		}
+		ret = append(ret, strings.TrimSuffix(strings.TrimPrefix(v, "{"), "}"))
+	}
+	return ret
+}
+
+func getImageLayers(repo *OSTreeRepo, manifestBlob string) ([]ImageLayer, error) {
+	var schema manifestSchema
+	if err := json.Unmarshal([]byte(manifestBlob), &schema); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal manifest")
+	}
+
+	var ret []ImageLayer
+	for _, l := range schema.LayersDescriptors {
+		ret = append(ret, ImageLayer{Digest: l.Digest.String(), Size: l.Size})
+	}
+	for _, l := range schema.FSLayers {
+		ret = append([]ImageLayer{{Digest: l.BlobSum.String()}}, ret...)
+	}
+	for i := range ret {
+		hex := strings.TrimPrefix(ret[i].Digest, "sha256:")
+		_, size, err := repo.readMetadata(fmt.Sprintf("%s/%s", ostreePrefix, hex), "docker.uncompressed_size")
+		if err == nil {
+			ret[i].UncompressedSize, _ = strconv.ParseUint(size, 10, 64)
+		}
+	}
+	return ret, nil
+}
+
+func (m *Manager) InspectImage(image string) (*ImageInspection, error) {
+	image, err := m.resolveImageName(image)
+	if err != nil {
+		return nil, err
+	}
+	srcRef, err := parseImageName(image)
+	if err != nil {
+		return nil, err
+	}
+	dockerRef := srcRef.DockerReference()
+	branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(dockerRef.String()))
+
+	repo, err := openRepo(m.repoPath)
+	if err != nil {
+		return nil, err
+	}
+	found, manifestBlob, err := repo.readMetadata(branch, "docker.manifest")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("cannot find the image %s", image)
+	}
+	_, imageID, err := repo.readMetadata(branch, "docker.digest")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &ImageInspection{
+		Name:         dockerRef.String(),
+		ImageID:      strings.TrimPrefix(imageID, "sha256:"),
+		OSTreeBranch: branch,
+		HasService:   true,
+		Variables:    []ImageVariable{},
+		HostFiles:    []string{},
+	}
+
+	ret.Layers, err = getImageLayers(repo, manifestBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	ostreeRef, err := getOSTreeReference(srcRef, m.repoPath)
+	if err != nil {
+		return nil, err
+	}
+	img, err := ostreeRef.NewImage(m.ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open image %s", image)
+	}
+	defer img.Close()
+	info, err := img.Inspect(m.ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "inspect image %s", image)
+	}
+	ret.Created = info.Created
+	ret.Architecture = info.Architecture
+	ret.OS = info.Os
+	ret.Labels = info.Labels
+
+	layers, err := getLayers([]byte(manifestBlob))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read layers")
+	}
+	exports, err := readImageExports(repo, layers)
+	if err != nil {
+		return nil, err
+	}
+	if err := inspectExports(exports, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+type exportEntry struct {
+	layer string
+	isDir bool
+}
+
+// imageExports is the exports directory of an image, merged from the
+// trees of its layers without checking them out.
+type imageExports struct {
+	repo *OSTreeRepo
+	// entries maps the paths relative to exports to the layer that
+	// provides them.
+	entries map[string]exportEntry
+}
+
+// exportsPath returns the path relative to exports of a path relative
+// to the root of a layer, "" for exports itself or for a parent.
+func exportsPath(path string) (string, bool) {
+	switch {
+	case path == "." || path == "exports":
+		return "", true
+	case strings.HasPrefix(path, "exports/"):
+		return strings.TrimPrefix(path, "exports/"), true
+	}
+	return "", false
+}
+
+// removeUnder deletes the entries under dir, "" for all of them.
+func (e *imageExports) removeUnder(dir string) {
+	for p := range e.entries {
+		if dir == "" || strings.HasPrefix(p, dir+"/") {
+			delete(e.entries, p)
+		}
+	}
+}
+
+func (e *imageExports) applyWhiteouts(w *layerWhiteouts) {
+	for _, d := range w.Opaque {
+		if p, ok := exportsPath(d); ok {
+			e.removeUnder(p)
+		}
+	}
+	for _, r := range w.Removed {
+		if p, ok := exportsPath(r); ok {
+			e.removeUnder(p)
+			delete(e.entries, p)
+		}
+	}
+}
+
+func readImageExports(repo *OSTreeRepo, layers []string) (*imageExports, error) {
+	ret := &imageExports{repo: repo, entries: make(map[string]exportEntry)}
+	for _, l := range layers {
+		whiteouts := &layerWhiteouts{}
+		/* The whiteouts at the root can hide exports itself.  */
+		err := repo.walkLayer(l, "", func(path string, isDir bool) error {
+			whiteouts.add(path)
+			if isDir {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "read the layer %s", l)
+		}
+		added := make(map[string]bool)
+		err = repo.walkLayer(l, "exports", func(path string, isDir bool) error {
+			if whiteouts.add(path) {
+				if isDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if p, ok := exportsPath(path); ok {
+				added[p] = isDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "read the layer %s", l)
+		}
+
+		/* The whiteouts hide the lower layers only.  */
+		ret.applyWhiteouts(whiteouts)
+		for p, isDir := range added {
+			if !isDir {
+				ret.removeUnder(p)
+			}
+			ret.entries[p] = exportEntry{layer: l, isDir: isDir}
+		}
+	}
+	return ret, nil
+}
+
+// readFile reads a file under exports, found is false when the image
+// has no such file.
+func (e *imageExports) readFile(path string) ([]byte, bool, error) {
+	entry, ok := e.entries[path]
+	if !ok || entry.isDir {
+		return nil, false, nil
+	}
+	return e.repo.readLayerFile(entry.layer, filepath.Join("exports", path))
+}
+
+func inspectExports(exports *imageExports, ret *ImageInspection) error {
+	data, found, err := exports.readFile("manifest.json")
+	if err != nil {
+		return errors.Wrapf(err, "read manifest.json")
+	}
+	if found {
+		ret.Manifest = &ContainerManifest{}
+		if err := json.Unmarshal(data, ret.Manifest); err != nil {
+			return errors.Wrapf(err, "parse manifest.json")
+		}
+		ret.HasService = !ret.Manifest.NoContainerService
+	}
+
+	for p, entry := range exports.entries {
+		if !entry.isDir && strings.HasPrefix(p, "hostfs/") {
+			ret.HostFiles = append(ret.HostFiles, strings.TrimPrefix(p, "hostfs"))
+		}
+	}
+
+	templates := []string{"config.json.template", "service.template", "tmpfiles.template"}
+	var manifestStrings []string
+	if ret.Manifest != nil {
+		for _, f := range ret.Manifest.InstalledFilesTemplate {
+			templates = append(templates, filepath.Join("hostfs", f))
+		}
+		for _, v := range ret.Manifest.RenameFiles {
+			manifestStrings = append(manifestStrings, v)
+		}
+		manifestStrings = append(manifestStrings, ret.Manifest.StateDirectories...)
+	}
+
+	used := make(map[string][]string)
+	for _, t := range templates {
+		data, found, err := exports.readFile(t)
+		if err != nil {
+			return errors.Wrapf(err, "read %s", t)
+		}
+		if !found {
+			continue
+		}
+		for _, v := range templateVariables(string(data)) {
+			used[v] = appendUnique(used[v], t)
+		}
+	}
+	for _, s := range manifestStrings {
+		for _, v := range templateVariables(s) {
+			used[v] = appendUnique(used[v], "manifest.json")
+		}
+	}
+
+	if ret.Manifest != nil {
+		for k := range ret.Manifest.DefaultValues {
+			if _, ok := used[k]; !ok {
+				used[k] = []string{}
+			}
+		}
+	}
+
+	automatic := make(map[string]bool)
+	for _, v := range automaticValues {
+		automatic[v] = true
+	}
+	for name, files := range used {
+		v := ImageVariable{
+			Name:      name,
+			Automatic: automatic[name],
+			Files:     files,
+		}
+		if ret.Manifest != nil {
+			if def, ok := ret.Manifest.DefaultValues[name]; ok {
+				v.Default = &def
+			}
+		}
+		v.Required = v.Default == nil && !v.Automatic
+		ret.Variables = append(ret.Variables, v)
+	}
+	sort.Slice(ret.Variables, func(i, j int) bool {
+		return ret.Variables[i].Name < ret.Variables[j].Name
+	})
+	sort.Strings(ret.HostFiles)
+	return nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, i := range list {
+		if i == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
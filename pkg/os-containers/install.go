@@ -2,13 +2,14 @@ package oscontainers
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 
 	"github.com/containers/image/docker/reference"
+	"github.com/pkg/errors"
 )
 
 func getDefaultContainerName(ref reference.Named) string {
@@ -24,13 +25,68 @@ func getDefaultContainerName(ref reference.Named) string {
 	return name
 }
 
-func InstallContainer(name, image string, set map[string]string, ctx *Context) error {
-	repoPath := getOSTreeRepo()
+type InstallOptions struct {
+	// Start starts the container once it is installed.
+	Start bool
+	// Force allows to install an image built for another platform.
+	Force bool
+	// Secrets maps the name of each secret to the file with its
+	// content.  The content is never stored in the info file.
+	Secrets map[string]string
+	// SecurityOpts are the security options in the label=OPTION,
+	// seccomp=FILE and apparmor=PROFILE forms.
+	SecurityOpts []string
+	// Confirm is asked to confirm the privileges of the container,
+	// they are accepted when it is nil.
+	Confirm ConfirmFunc
+}
+
+type UpdateOptions struct {
+	// Rebase switches the container to a different image.
+	Rebase string
+	// Runtime switches the container to a different runtime.
+	Runtime string
+	// Pull pulls the image before updating the container.
+	Pull bool
+	// Secrets maps the name of each secret to the file with its
+	// content, they are added to the ones of the container or
+	// replace them.
+	Secrets map[string]string
+	// SecurityOpts replace the security options of the same kind of
+	// the container.
+	SecurityOpts []string
+	// Unset are the values set for the container that are dropped,
+	// they get their default again.
+	Unset []string
+	// Confirm is asked to confirm the privileges that the new
+	// deployment adds, they are accepted when it is nil.
+	Confirm ConfirmFunc
+}
+
+func valueNames(set map[string]string) []string {
+	var ret []string
+	for k := range set {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+func (m *Manager) Install(name, image string, set map[string]string, opts InstallOptions) error {
+	repoPath := m.repoPath
+
+	if opts.Start && m.root != "" {
+		return fmt.Errorf("containers cannot be started in an alternate root")
+	}
 
 	if _, err := os.Stat(repoPath); err != nil {
 		return err
 	}
 
+	image, err := m.resolveImageName(image)
+	if err != nil {
+		return err
+	}
+
 	srcRef, err := parseImageName(image)
 	if err != nil {
 		return err
@@ -42,7 +98,11 @@ func InstallContainer(name, image string, set map[string]string, ctx *Context) e
 		name = getDefaultContainerName(dockerRef)
 	}
 
-	checkouts := getCheckoutsDirectory()
+	if err := m.checkImagePolicy(name, dockerRef); err != nil {
+		return err
+	}
+
+	checkouts := m.checkoutsPath
 
 	checkout := filepath.Join(checkouts, name)
 	if _, err := os.Stat(checkout); err == nil {
@@ -61,11 +121,15 @@ func InstallContainer(name, image string, set map[string]string, ctx *Context) e
 	}
 
 	if !hasBranch {
-		if err := PullImage(false, image); err != nil {
+		if err := m.Pull(false, image); err != nil {
 			return err
 		}
 	}
 
+	if err := m.checkImagePlatform(repo, srcRef, branch, opts.Force); err != nil {
+		return err
+	}
+
 	_, imageID, err := repo.readMetadata(branch, "docker.digest")
 	if err != nil {
 		return err
@@ -73,16 +137,56 @@ func InstallContainer(name, image string, set map[string]string, ctx *Context) e
 
 	imageID = strings.TrimPrefix(imageID, "sha256:")
 
-	container, err := checkoutContainerTo(branch, repo, checkouts, set, name, image, imageID, 0, ctx)
+	if err := m.storeSecrets(name, opts.Secrets); err != nil {
+		os.RemoveAll(m.secretsDir(name))
+		return err
+	}
+
+	container, err := m.withSecurityOpts(opts.SecurityOpts).checkoutContainerTo(branch, repo, checkouts, set, name, image, imageID, 0)
+	if err != nil {
+		os.RemoveAll(m.secretsDir(name))
+		return err
+	}
+
+	container.SetValues = sortedUnique(valueNames(set))
+
+	destDir := filepath.Join(checkouts, fmt.Sprintf("%s.0", name))
+	err = m.checkDeploymentPolicy(name, destDir, container)
+	if err == nil {
+		err = m.confirmPrivileges(opts.Confirm, destDir, container, nil)
+	}
+	if err == nil {
+		err = m.runHook(container, destDir, preInstallHook)
+	}
 	if err != nil {
+		removeDeployment(destDir)
+		os.RemoveAll(m.secretsDir(name))
+		m.unloadAppArmorProfile(name)
 		return err
 	}
 
-	return makeDeploymentActive(container, checkouts, name, false, 0)
+	if err := m.makeDeploymentActive(container, checkouts, name, false, 0); err != nil {
+		return err
+	}
+	if err := m.runHook(container, destDir, postInstallHook); err != nil {
+		/* Leave the host as if the container was never installed.  */
+		if err2 := m.withoutHooks().Uninstall(name, false); err2 != nil {
+			m.logger.Printf("could not remove the container %s: %v\n", name, err2)
+		}
+		return err
+	}
+	if opts.Start && container.HasContainerService && m.root == "" {
+		if _, err := m.systemctlCommand("start", name, false, false); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func UninstallContainer(name string) error {
-	checkouts := getCheckoutsDirectory()
+// Uninstall removes a container.  Its volumes are kept, unless purge
+// is set.
+func (m *Manager) Uninstall(name string, purge bool) error {
+	checkouts := m.checkoutsPath
 
 	ctr, err := ReadContainer(checkouts, name, nil)
 	if err != nil {
@@ -90,13 +194,27 @@ func UninstallContainer(name string) error {
 		return err
 	}
 
-	err = destroyActiveCheckout(ctr, checkouts)
+	if err := m.runHook(ctr, filepath.Join(checkouts, name), preUninstallHook); err != nil {
+		return err
+	}
+
+	err = m.destroyActiveCheckout(ctr, checkouts)
 	if err != nil {
 		deleteCheckouts(name, checkouts)
 		return err
 	}
 
-	return deleteCheckouts(name, checkouts)
+	if err := deleteCheckouts(name, checkouts); err != nil {
+		return err
+	}
+	if err := m.deleteSecrets(ctr); err != nil {
+		return err
+	}
+	m.unloadAppArmorProfile(name)
+	if purge {
+		return m.deleteVolumes(name)
+	}
+	return nil
 }
 
 func getCurrentRevision(checkout string) (int, error) {
@@ -112,10 +230,11 @@ func getCurrentRevision(checkout string) (int, error) {
 	return strconv.Atoi(target[ind+1:])
 }
 
-func UpdateContainer(name string, set map[string]string, rebase string, ctx *Context) error {
-	repoPath := getOSTreeRepo()
+// Update deploys a new version of a container.
+func (m *Manager) Update(name string, set map[string]string, opts UpdateOptions) error {
+	repoPath := m.repoPath
 
-	checkouts := getCheckoutsDirectory()
+	checkouts := m.checkoutsPath
 
 	ctr, err := ReadContainer(checkouts, name, nil)
 	if err != nil {
@@ -137,8 +256,11 @@ func UpdateContainer(name string, set map[string]string, rebase string, ctx *Con
 	}
 
 	image := ctr.Image
-	if rebase != "" {
-		image = rebase
+	if opts.Rebase != "" {
+		image, err = m.resolveImageName(opts.Rebase)
+		if err != nil {
+			return err
+		}
 	}
 
 	srcRef, err := parseImageName(image)
@@ -148,13 +270,23 @@ func UpdateContainer(name string, set map[string]string, rebase string, ctx *Con
 
 	dockerRef := srcRef.DockerReference()
 
+	if err := m.checkImagePolicy(name, dockerRef); err != nil {
+		return err
+	}
+
+	if opts.Pull {
+		if err := m.Pull(false, image); err != nil {
+			return err
+		}
+	}
+
 	branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(dockerRef.String()))
 	hasBranch, err := repo.hasBranch(branch)
 	if err != nil {
 		return err
 	}
 	if !hasBranch {
-		return fmt.Errorf("cannot find the specified image")
+		return fmt.Errorf("cannot find the image %s, use --pull to fetch it", image)
 	}
 
 	_, imageID, err := repo.readMetadata(branch, "docker.digest")
@@ -164,8 +296,15 @@ func UpdateContainer(name string, set map[string]string, rebase string, ctx *Con
 
 	imageID = strings.TrimPrefix(imageID, "sha256:")
 
-	if imageID == ctr.Revision && len(set) == 0 {
-		log.Println("latest version already deployed")
+	runtime := opts.Runtime
+	if runtime == "" {
+		runtime = ctr.Runtime
+	}
+
+	securityOpts := mergeSecurityOpts(ctr.SecurityOpts, opts.SecurityOpts)
+
+	if imageID == ctr.Revision && len(set) == 0 && len(opts.Unset) == 0 && len(opts.Secrets) == 0 && runtime == ctr.Runtime && reflect.DeepEqual(securityOpts, ctr.SecurityOpts) {
+		m.logger.Println("latest version already deployed")
 		return nil
 	}
 
@@ -173,31 +312,110 @@ func UpdateContainer(name string, set map[string]string, rebase string, ctx *Con
 	for k, v := range ctr.Values {
 		mergedSet[k] = fmt.Sprintf("%v", v)
 	}
+	for _, k := range opts.Unset {
+		delete(mergedSet, k)
+	}
 	for k, v := range set {
 		mergedSet[k] = v
 	}
-	newDeployment, err := checkoutContainerTo(branch, repo, checkouts, mergedSet, name, image, imageID, nextRevision, ctx)
+	var previousPrivileges *PrivilegeSummary
+	if opts.Confirm != nil {
+		previousPrivileges, err = m.privilegeSummary(filepath.Join(checkouts, fmt.Sprintf("%s.%d", name, rev)), ctr)
+		if err != nil {
+			return err
+		}
+	}
+	/* The new secrets are needed by the checkout and the hooks, the
+	   previous store is put back if the update fails.  */
+	if err := m.snapshotSecrets(name); err != nil {
+		return err
+	}
+	if err := m.storeSecrets(name, opts.Secrets); err != nil {
+		m.restoreSecrets(name)
+		return err
+	}
+	newDeployment, err := m.withRuntime(runtime).withSecurityOpts(securityOpts).checkoutContainerTo(branch, repo, checkouts, mergedSet, name, image, imageID, nextRevision)
 	if err != nil {
+		m.restoreSecrets(name)
 		return err
 	}
+	newDeployment.SetValues = sortedUnique(append(notIn(ctr.SetValues, opts.Unset), valueNames(set)...))
 
-	_, err = systemctlCommand("is-active", name, false, true)
-	serviceActive := err == nil
-
-	if err := destroyActiveCheckout(ctr, checkouts); err != nil {
+	newDestDir := filepath.Join(checkouts, fmt.Sprintf("%s.%d", name, nextRevision))
+	err = m.checkDeploymentPolicy(name, newDestDir, newDeployment)
+	if err == nil {
+		err = m.confirmPrivileges(opts.Confirm, newDestDir, newDeployment, previousPrivileges)
+	}
+	if err == nil {
+		err = m.runHook(newDeployment, newDestDir, preUpdateHook)
+	}
+	if err != nil {
+		removeDeployment(newDestDir)
+		m.restoreSecrets(name)
 		return err
 	}
-	if err := makeDeploymentActive(newDeployment, checkouts, name, false, nextRevision); err != nil {
+
+	serviceActive := m.isUnitActive(name)
+
+	err = m.destroyActiveCheckout(ctr, checkouts)
+	if err == nil {
+		err = m.makeDeploymentActive(newDeployment, checkouts, name, false, nextRevision)
+	}
+	if err == nil {
+		err = m.runHook(newDeployment, newDestDir, postUpdateHook)
+	}
+	if err != nil {
+		/* Go back to the previous deployment and drop the new one.  */
+		if err2 := m.restoreSecrets(name); err2 != nil {
+			m.logger.Printf("could not restore the secrets of %s: %v\n", name, err2)
+		}
+		if err2 := m.restoreDeployment(name, rev); err2 != nil {
+			m.logger.Printf("could not restore the previous deployment of %s: %v\n", name, err2)
+		} else {
+			removeDeployment(newDestDir)
+		}
+		if serviceActive {
+			m.systemctlCommand("start", name, false, false)
+		}
 		return err
 	}
+	if err := m.keepPreviousSecrets(name); err != nil {
+		m.logger.Printf("could not keep the previous secrets of %s: %v\n", name, err)
+	}
 	if serviceActive {
-		systemctlCommand("start", name, false, false)
+		m.systemctlCommand("start", name, false, false)
+	}
+	if m.discardPrev {
+		previous := filepath.Join(checkouts, fmt.Sprintf("%s.%d", name, rev))
+		if err := removeDeployment(previous); err != nil {
+			return errors.Wrapf(err, "delete the previous deployment %s", previous)
+		}
+		m.logger.Printf("deleted the previous deployment %s\n", previous)
 	}
 	return nil
 }
 
-func RollbackContainer(name string) error {
-	checkouts := getCheckoutsDirectory()
+// restoreDeployment makes the deployment rev of a container active
+// again after a failed update, whatever state the update left.
+func (m *Manager) restoreDeployment(name string, rev int) error {
+	checkouts := m.checkoutsPath
+
+	previous, err := ReadContainer(checkouts, name, &rev)
+	if err != nil {
+		return err
+	}
+	if current, err := ReadContainer(checkouts, name, nil); err == nil {
+		if err := m.destroyActiveCheckout(current, checkouts); err != nil {
+			m.logger.Printf("could not deactivate the deployment of %s: %v\n", name, err)
+		}
+	}
+	/* The symlink may be left when the deactivation failed.  */
+	os.Remove(filepath.Join(checkouts, name))
+	return m.makeDeploymentActive(previous, checkouts, name, false, rev)
+}
+
+func (m *Manager) Rollback(name string) error {
+	checkouts := m.checkoutsPath
 
 	ctr, err := ReadContainer(checkouts, name, nil)
 	if err != nil {
@@ -216,17 +434,19 @@ func RollbackContainer(name string) error {
 		return err
 	}
 
-	_, err = systemctlCommand("is-active", name, false, true)
-	serviceActive := err == nil
+	serviceActive := m.isUnitActive(name)
 
-	if err := destroyActiveCheckout(ctr, checkouts); err != nil {
+	if err := m.destroyActiveCheckout(ctr, checkouts); err != nil {
+		return err
+	}
+	if err := m.makeDeploymentActive(newDeployment, checkouts, name, false, nextRevision); err != nil {
 		return err
 	}
-	if err := makeDeploymentActive(newDeployment, checkouts, name, false, nextRevision); err != nil {
+	if err := m.swapSecrets(name); err != nil {
 		return err
 	}
 	if serviceActive {
-		systemctlCommand("start", name, false, false)
+		m.systemctlCommand("start", name, false, false)
 	}
 	return nil
 }
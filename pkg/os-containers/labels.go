@@ -0,0 +1,67 @@
+package oscontainers
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	selinux "github.com/opencontainers/selinux/go-selinux"
+	"github.com/opencontainers/selinux/go-selinux/label"
+)
+
+// readDeployments reads the info file of every deployment in checkouts.
+func readDeployments(checkouts string) ([]*Container, error) {
+	infos, err := filepath.Glob(filepath.Join(checkouts, "*.*", "info"))
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Container
+	for _, info := range infos {
+		deployment := filepath.Base(filepath.Dir(info))
+		i := strings.LastIndex(deployment, ".")
+		n, err := strconv.Atoi(deployment[i+1:])
+		if err != nil {
+			continue
+		}
+		c, err := ReadContainer(checkouts, deployment[:i], &n)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// containerLabels returns the process and mount labels for a new
+// deployment of the container name.  The MCS categories of the current
+// deployment are kept, so that the files written by the container are
+// still accessible after an update.  A new container gets categories
+// that no other container uses.
+func (m *Manager) containerLabels(checkouts, name string, opts []string) (string, string, error) {
+	if m.rootless || !selinux.GetEnabled() {
+		return "", "", nil
+	}
+
+	hasLevel := false
+	for _, o := range opts {
+		if strings.HasPrefix(o, "level:") {
+			hasLevel = true
+		}
+	}
+	if previous, err := ReadContainer(checkouts, name, nil); err == nil && previous.MountLabel != "" {
+		if level := selinux.NewContext(previous.MountLabel)["level"]; level != "" && !hasLevel {
+			opts = append(opts, "level:"+level)
+		}
+	} else {
+		deployments, err := readDeployments(m.checkoutsPath)
+		if err != nil {
+			return "", "", err
+		}
+		for _, d := range deployments {
+			if d.ProcessLabel != "" {
+				label.ReserveLabel(d.ProcessLabel)
+			}
+		}
+	}
+	return label.InitLabels(opts)
+}
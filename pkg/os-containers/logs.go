@@ -0,0 +1,127 @@
+package oscontainers
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type LogsOptions struct {
+	Follow bool
+	Since  string
+	Lines  int
+	JSON   bool
+}
+
+// journalWriter forwards the output of a command to systemd-cat.
+// Errors are ignored so that a failure of the journal doesn't
+// interrupt the command.
+type journalWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (j *journalWriter) Write(p []byte) (int, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.w.Write(p)
+	return len(p), nil
+}
+
+// containerUnits returns the units of a container: its service, the
+// units that it installs on the host and the mount unit of an overlay
+// deployment.
+func (m *Manager) containerUnits(c *Container) []string {
+	var units []string
+	if c.HasContainerService {
+		units = append(units, fmt.Sprintf("%s.service", c.Name))
+	}
+	for _, f := range c.InstalledFiles {
+		if !strings.Contains(f, "/systemd/") {
+			continue
+		}
+		switch filepath.Ext(f) {
+		case ".service", ".timer", ".socket":
+			units = append(units, filepath.Base(f))
+		}
+	}
+	if c.Overlay {
+		if destDir, err := filepath.EvalSymlinks(filepath.Join(m.checkoutsPath, c.Name)); err == nil {
+			units = append(units, m.overlayMountUnit(destDir))
+		}
+	}
+	return units
+}
+
+func (m *Manager) Logs(name string, opts LogsOptions) error {
+	if m.root != "" {
+		return fmt.Errorf("logs are not available for an alternate root")
+	}
+
+	c, err := ReadContainer(m.checkoutsPath, name, nil)
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	unitField := "_SYSTEMD_UNIT"
+	if m.rootless {
+		args = append(args, "--user")
+		unitField = "_SYSTEMD_USER_UNIT"
+	}
+	if opts.Follow {
+		args = append(args, "--follow")
+	}
+	if opts.Since != "" {
+		args = append(args, "--since", opts.Since)
+	}
+	if opts.Lines > 0 {
+		args = append(args, "--lines", fmt.Sprintf("%d", opts.Lines))
+	}
+	if opts.JSON {
+		args = append(args, "--output", "json")
+	}
+
+	/* Output of the units and of the commands started with run.  */
+	for _, u := range m.containerUnits(c) {
+		args = append(args, fmt.Sprintf("%s=%s", unitField, u), "+")
+	}
+	args = append(args, fmt.Sprintf("SYSLOG_IDENTIFIER=%s", c.Name))
+
+	cmd := exec.CommandContext(m.ctx, "journalctl", args...)
+	cmd.Stdout = m.output
+	cmd.Stderr = m.errOutput
+	return cmd.Run()
+}
+
+func (m *Manager) runWithJournal(cmd *exec.Cmd, identifier string) error {
+	cmd.Stdout = m.output
+	cmd.Stderr = m.errOutput
+	cmd.Stdin = m.input
+
+	catPath, err := exec.LookPath("systemd-cat")
+	if m.root != "" || err != nil {
+		return cmd.Run()
+	}
+	cat := exec.Command(catPath, "--identifier", identifier)
+	journal, err := cat.StdinPipe()
+	if err != nil {
+		return cmd.Run()
+	}
+	if err := cat.Start(); err != nil {
+		m.logger.Printf("cannot write the output to the journal: %v", err)
+		return cmd.Run()
+	}
+
+	w := &journalWriter{w: journal}
+	cmd.Stdout = io.MultiWriter(m.output, w)
+	cmd.Stderr = io.MultiWriter(m.errOutput, w)
+	err = cmd.Run()
+
+	journal.Close()
+	cat.Wait()
+	return err
+}
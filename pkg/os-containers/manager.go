@@ -0,0 +1,410 @@
+package oscontainers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Options configures a Manager.  Empty paths are replaced with the
+// defaults for a root or a rootless Manager.
+type Options struct {
+	// RepoPath is the OSTree repository where images are stored.
+	RepoPath string
+	// CheckoutsPath is the directory where containers are checked out.
+	CheckoutsPath string
+	// UnitsPath is the directory for the systemd unit files.
+	UnitsPath string
+	// TmpFilesPath is the directory for the systemd-tmpfiles files.
+	TmpFilesPath string
+	// LayersPath is the cache of the layers shared by the overlay
+	// deployments.  Defaults to a directory next to RepoPath.
+	LayersPath string
+	// VolumesPath is where the persistent volumes of the containers
+	// are stored.  Defaults to a directory next to RepoPath.
+	VolumesPath string
+	// SecretsPath is where the secrets of the containers are stored,
+	// readable only by the owner.  Defaults to a directory next to
+	// RepoPath.
+	SecretsPath string
+	// Runtime is the name of the OCI runtime used for new
+	// deployments, or the path to its executable.
+	Runtime string
+	// Runtimes adds runtime profiles to the built-in ones (runc,
+	// crun, runsc and kata) or replaces them.
+	Runtimes map[string]RuntimeProfile
+	// SignaturePolicy is the signature policy file used to verify
+	// images.  Defaults to /etc/containers/policy.json.
+	SignaturePolicy string
+	// AdminPolicy is the file with the rules for what the containers
+	// may do, checked on install and update.  Defaults to
+	// /etc/containers/os-containers-policy.conf, a missing file allows
+	// everything.
+	AdminPolicy string
+	// InsecureRegistries are accessed without verifying TLS.
+	InsecureRegistries []string
+	// RegistriesConf is the registries.conf file used to resolve
+	// short image names.
+	RegistriesConf string
+	// Registry is used for short image names instead of searching
+	// the registries.
+	Registry string
+	// DefaultValues are used for the templates, before the values
+	// set for the container.
+	DefaultValues map[string]string
+	// DiscardPreviousDeployment deletes the previous deployment after
+	// an update, a rollback is not possible then.
+	DiscardPreviousDeployment bool
+	// OverlayDeployments mounts the rootfs of new deployments with
+	// overlayfs on top of the layer cache, instead of checking out
+	// all the layers.  Not supported for rootless containers.
+	OverlayDeployments bool
+	// SkipHooks doesn't run the hooks shipped by the images in
+	// exports/hooks.
+	SkipHooks bool
+	// Rootless selects the user systemd instance and disables
+	// the copy of files to the host.
+	Rootless bool
+	// Home is the home directory of the user, used for the paths of
+	// a rootless Manager.  Defaults to $HOME.
+	Home string
+	// ConfigHome is the directory of the configuration files of the
+	// user.  Defaults to $XDG_CONFIG_HOME or Home/.config.
+	ConfigHome string
+	// RuntimeDir is the RUN_DIRECTORY of rootless containers.
+	// Defaults to $XDG_RUNTIME_DIR or /run/user/UID.
+	RuntimeDir string
+	// UID and GID are the user that owns the containers.  When both
+	// are 0, the effective user and group of the process are used.
+	UID int
+	GID int
+	// User is the name of the user, used for the ID mappings of
+	// rootless containers.  Defaults to $USER or the name of UID.
+	User string
+	// Root installs into an alternate root, such as an OS image
+	// being built.  All the paths are relative to Root, units are
+	// enabled without using the running systemd.
+	Root string
+	// Logger receives the progress messages.  Defaults to the
+	// standard logger.
+	Logger *log.Logger
+	// Output receives the output of pulls and of the commands run
+	// in containers.  Defaults to os.Stdout.
+	Output io.Writer
+	// ErrOutput receives the error output of the commands run in
+	// containers and of journalctl.  Defaults to os.Stderr.
+	ErrOutput io.Writer
+	// Input is the standard input of the commands run in containers.
+	// They have no input when it is not set.
+	Input io.Reader
+	// Context cancels the running operations.  Defaults to
+	// context.Background().
+	Context context.Context
+}
+
+// Manager installs and manages system containers.
+type Manager struct {
+	repoPath       string
+	checkoutsPath  string
+	unitsPath      string
+	tmpFilesPath   string
+	layersPath     string
+	volumesPath    string
+	secretsPath    string
+	securityOpts   []string
+	apparmorPath   string
+	adminPolicy    *adminPolicy
+	runtime        string
+	runtimes       map[string]RuntimeProfile
+	policyPath     string
+	insecure       []string
+	registriesConf string
+	registry       string
+	values         map[string]string
+	discardPrev    bool
+	overlay        bool
+	skipHooks      bool
+	rootless       bool
+	home           string
+	runtimeDir     string
+	uid            int
+	gid            int
+	userName       string
+	root           string
+	logger         *log.Logger
+	output         io.Writer
+	errOutput      io.Writer
+	input          io.Reader
+	ctx            context.Context
+	// repoLock serializes the writes to the repository of the
+	// concurrent pulls.
+	repoLock *sync.Mutex
+}
+
+func getDataHome(home string) string {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		resolvedHome, err := filepath.EvalSymlinks(home)
+		if err == nil {
+			home = resolvedHome
+		}
+		dataDir = filepath.Join(home, ".local", "share")
+	}
+	return dataDir
+}
+
+// setUserDefaults fills the settings of the user that are not set
+// from the process and its environment.
+func setUserDefaults(opts *Options) {
+	if opts.UID == 0 && opts.GID == 0 {
+		opts.UID = os.Geteuid()
+		opts.GID = os.Getegid()
+	}
+	if opts.Home == "" {
+		opts.Home = os.Getenv("HOME")
+	}
+	if opts.ConfigHome == "" {
+		opts.ConfigHome = os.Getenv("XDG_CONFIG_HOME")
+		if opts.ConfigHome == "" {
+			opts.ConfigHome = filepath.Join(opts.Home, ".config")
+		}
+	}
+	if opts.RuntimeDir == "" {
+		opts.RuntimeDir = os.Getenv("XDG_RUNTIME_DIR")
+		if opts.RuntimeDir == "" {
+			opts.RuntimeDir = fmt.Sprintf("/run/user/%d", opts.UID)
+		}
+	}
+	if opts.User == "" {
+		opts.User = os.Getenv("USER")
+	}
+}
+
+// defaultOptions returns opts with the default paths for its user.
+func defaultOptions(opts Options) Options {
+	opts.Runtime = defaultRuntimeName
+	if !opts.Rootless {
+		opts.RepoPath = "/var/lib/containers/atomic/.storage/repo"
+		opts.CheckoutsPath = "/var/lib/containers/atomic"
+		opts.UnitsPath = "/etc/systemd/system"
+		opts.TmpFilesPath = "/etc/tmpfiles.d"
+		return opts
+	}
+
+	opts.TmpFilesPath = filepath.Join(opts.Home, ".containers/tmpfiles")
+	if xdgDataDir := os.Getenv("XDG_DATA_DIR"); xdgDataDir != "" {
+		opts.TmpFilesPath = filepath.Join(xdgDataDir, "containers/tmpfiles")
+	}
+	opts.RepoPath = filepath.Join(getDataHome(opts.Home), "containers/atomic/.storage/repo")
+	opts.CheckoutsPath = filepath.Join(getDataHome(opts.Home), "containers/atomic")
+	opts.UnitsPath = filepath.Join(opts.Home, ".config/systemd/user")
+	return opts
+}
+
+// DefaultOptions returns the options for the current user.  The
+// settings in /etc/containers/os-containers.conf and, for rootless
+// users, in $XDG_CONFIG_HOME/containers/os-containers.conf override
+// the defaults, the OSTREE_REPO, OS_CONTAINERS_CHECKOUT_PATH and
+// RUNTIME environment variables override the configuration files.
+func DefaultOptions() (Options, error) {
+	rootless := os.Geteuid() != 0
+	opts := Options{Rootless: rootless}
+	setUserDefaults(&opts)
+	opts = defaultOptions(opts)
+	if err := readConfigFile(systemConfigFile, &opts, !rootless); err != nil {
+		return opts, err
+	}
+	if rootless {
+		if err := readConfigFile(getUserConfigFile(opts.ConfigHome), &opts, true); err != nil {
+			return opts, err
+		}
+	}
+	if repo := os.Getenv("OSTREE_REPO"); repo != "" {
+		opts.RepoPath = repo
+	}
+	if checkouts := os.Getenv("OS_CONTAINERS_CHECKOUT_PATH"); checkouts != "" {
+		opts.CheckoutsPath = checkouts
+	}
+	if runtime := os.Getenv("RUNTIME"); runtime != "" {
+		opts.Runtime = runtime
+	}
+	return opts, nil
+}
+
+// NewManager creates a Manager from the given options.
+func NewManager(opts Options) (*Manager, error) {
+	setUserDefaults(&opts)
+	defaults := defaultOptions(opts)
+	if opts.RepoPath == "" {
+		opts.RepoPath = defaults.RepoPath
+	}
+	if opts.CheckoutsPath == "" {
+		opts.CheckoutsPath = defaults.CheckoutsPath
+	}
+	if opts.UnitsPath == "" {
+		opts.UnitsPath = defaults.UnitsPath
+	}
+	if opts.TmpFilesPath == "" {
+		opts.TmpFilesPath = defaults.TmpFilesPath
+	}
+	if opts.Runtime == "" {
+		opts.Runtime = defaults.Runtime
+	}
+	if opts.RegistriesConf == "" {
+		opts.RegistriesConf = getRegistriesConfFile(opts.Rootless, opts.ConfigHome)
+	}
+	if opts.AdminPolicy == "" {
+		opts.AdminPolicy = systemPolicyFile
+	}
+	adminPolicy, err := readAdminPolicy(opts.AdminPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Root != "" {
+		if opts.Rootless {
+			return nil, fmt.Errorf("an alternate root cannot be used by a rootless Manager")
+		}
+		root, err := filepath.Abs(opts.Root)
+		if err != nil {
+			return nil, err
+		}
+		opts.Root = root
+		opts.RepoPath = filepath.Join(root, opts.RepoPath)
+		opts.CheckoutsPath = filepath.Join(root, opts.CheckoutsPath)
+		opts.UnitsPath = filepath.Join(root, opts.UnitsPath)
+		opts.TmpFilesPath = filepath.Join(root, opts.TmpFilesPath)
+		if opts.LayersPath != "" {
+			opts.LayersPath = filepath.Join(root, opts.LayersPath)
+		}
+		if opts.VolumesPath != "" {
+			opts.VolumesPath = filepath.Join(root, opts.VolumesPath)
+		}
+		if opts.SecretsPath != "" {
+			opts.SecretsPath = filepath.Join(root, opts.SecretsPath)
+		}
+	}
+	if opts.LayersPath == "" {
+		opts.LayersPath = filepath.Join(filepath.Dir(opts.RepoPath), "layers")
+	}
+	if opts.VolumesPath == "" {
+		opts.VolumesPath = filepath.Join(filepath.Dir(opts.RepoPath), "volumes")
+	}
+	if opts.SecretsPath == "" {
+		opts.SecretsPath = filepath.Join(filepath.Dir(opts.RepoPath), "secrets")
+	}
+	if opts.OverlayDeployments && opts.Rootless {
+		return nil, fmt.Errorf("overlay deployments are not supported for rootless containers")
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	if opts.ErrOutput == nil {
+		opts.ErrOutput = os.Stderr
+	}
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	runtimes := builtinRuntimes()
+	for name, profile := range opts.Runtimes {
+		runtimes[name] = profile
+	}
+
+	return &Manager{
+		repoPath:       opts.RepoPath,
+		checkoutsPath:  opts.CheckoutsPath,
+		unitsPath:      opts.UnitsPath,
+		tmpFilesPath:   opts.TmpFilesPath,
+		layersPath:     opts.LayersPath,
+		volumesPath:    opts.VolumesPath,
+		secretsPath:    opts.SecretsPath,
+		apparmorPath:   filepath.Join(opts.Root, apparmorProfilesDir),
+		adminPolicy:    adminPolicy,
+		runtime:        opts.Runtime,
+		runtimes:       runtimes,
+		policyPath:     opts.SignaturePolicy,
+		insecure:       opts.InsecureRegistries,
+		registriesConf: opts.RegistriesConf,
+		registry:       opts.Registry,
+		values:         opts.DefaultValues,
+		discardPrev:    opts.DiscardPreviousDeployment,
+		overlay:        opts.OverlayDeployments,
+		skipHooks:      opts.SkipHooks,
+		rootless:       opts.Rootless,
+		home:           opts.Home,
+		runtimeDir:     opts.RuntimeDir,
+		uid:            opts.UID,
+		gid:            opts.GID,
+		userName:       opts.User,
+		root:           opts.Root,
+		logger:         opts.Logger,
+		output:         opts.Output,
+		errOutput:      opts.ErrOutput,
+		input:          opts.Input,
+		ctx:            opts.Context,
+		repoLock:       &sync.Mutex{},
+	}, nil
+}
+
+// withRuntime returns a copy of the Manager that uses a different
+// OCI runtime for new deployments.
+func (m *Manager) withRuntime(runtime string) *Manager {
+	if runtime == "" {
+		return m
+	}
+	n := *m
+	n.runtime = runtime
+	return &n
+}
+
+// withOverlay returns a copy of the Manager that creates overlay
+// deployments or full checkouts.
+func (m *Manager) withOverlay(overlay bool) *Manager {
+	if m.overlay == overlay {
+		return m
+	}
+	n := *m
+	n.overlay = overlay
+	return &n
+}
+
+// withSecurityOpts returns a copy of the Manager that creates the
+// deployments with the specified security options.
+func (m *Manager) withSecurityOpts(opts []string) *Manager {
+	n := *m
+	n.securityOpts = opts
+	return &n
+}
+
+// withoutHooks returns a copy of the Manager that doesn't run the hooks
+// of the images.
+func (m *Manager) withoutHooks() *Manager {
+	n := *m
+	n.skipHooks = true
+	return &n
+}
+
+// underRoot returns where the path p of the target system is found
+// when installing into an alternate root.
+func (m *Manager) underRoot(p string) string {
+	if m.root == "" {
+		return p
+	}
+	return filepath.Join(m.root, p)
+}
+
+// stripRoot returns the path on the target system for a path under
+// the alternate root.
+func (m *Manager) stripRoot(p string) string {
+	if m.root == "" || !strings.HasPrefix(p, m.root+"/") {
+		return p
+	}
+	return strings.TrimPrefix(p, m.root)
+}
@@ -2,22 +2,10 @@
 
 package oscontainers
 
-import (
-	"os"
-
-	selinux "github.com/opencontainers/selinux/go-selinux"
-	"github.com/pkg/errors"
-)
-
-// #cgo pkg-config: libselinux
-// #include <selinux/selinux.h>
-// #include <selinux/label.h>
-import "C"
-
 type SELinuxCtx struct {
 }
 
-func makeSELinuxCtx() (*SelinuxCtx, error) {
+func makeSELinuxCtx() (*SELinuxCtx, error) {
 	return &SELinuxCtx{}, nil
 }
 
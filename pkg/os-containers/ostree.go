@@ -3,8 +3,10 @@ package oscontainers
 import (
 	"bytes"
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"unsafe"
 
 	glib "github.com/ostreedev/ostree-go/pkg/glibobject"
@@ -17,15 +19,58 @@ import (
 // #include <stdlib.h>
 // #include <ostree.h>
 // #include <gio/ginputstream.h>
-// static OstreeRepoCheckoutAtOptions *MakeOSTreeCheckoutOptions() {
+// static OstreeRepoCheckoutAtOptions *MakeOSTreeCheckoutOptions(int user, int copy) {
 //   OstreeRepoCheckoutAtOptions *r = malloc (sizeof (*r));
 //   if (r == NULL)
 //     return r;
 //   memset (r, 0, sizeof (*r));
-//   r->mode = geteuid () != 0 ? OSTREE_REPO_CHECKOUT_MODE_USER : OSTREE_REPO_CHECKOUT_MODE_NONE;
+//   r->mode = user ? OSTREE_REPO_CHECKOUT_MODE_USER : OSTREE_REPO_CHECKOUT_MODE_NONE;
 //   r->overwrite_mode = OSTREE_REPO_CHECKOUT_OVERWRITE_UNION_FILES;
+//   r->force_copy = copy;
 //   return r;
 // }
+// static gboolean AddCommitMetadata(OstreeRepo *repo, const char *branch, const char *rev,
+//                                   const char *key, const char *value, GError **error) {
+//   gboolean ret = FALSE;
+//   GVariant *commit = NULL, *metadata = NULL, *newMetadata = NULL;
+//   GVariantDict dict;
+//   GFile *root = NULL;
+//   char *parent = NULL, *checksum = NULL;
+//   const char *subject = NULL, *body = NULL;
+//   if (!ostree_repo_load_variant (repo, OSTREE_OBJECT_TYPE_COMMIT, rev, &commit, error))
+//     return FALSE;
+//   if (!ostree_repo_read_commit (repo, rev, &root, NULL, NULL, error))
+//     goto out;
+//   metadata = g_variant_get_child_value (commit, 0);
+//   g_variant_dict_init (&dict, metadata);
+//   g_variant_dict_insert_value (&dict, key, g_variant_new_string (value));
+//   newMetadata = g_variant_ref_sink (g_variant_dict_end (&dict));
+//   g_variant_get_child (commit, 3, "&s", &subject);
+//   g_variant_get_child (commit, 4, "&s", &body);
+//   parent = ostree_commit_get_parent (commit);
+//   if (!ostree_repo_prepare_transaction (repo, NULL, NULL, error))
+//     goto out;
+//   if (!ostree_repo_write_commit_with_time (repo, parent, subject, body, newMetadata, OSTREE_REPO_FILE (root),
+//                                            ostree_commit_get_timestamp (commit), &checksum, NULL, error)) {
+//     ostree_repo_abort_transaction (repo, NULL, NULL);
+//     goto out;
+//   }
+//   ostree_repo_transaction_set_ref (repo, NULL, branch, checksum);
+//   if (!ostree_repo_commit_transaction (repo, NULL, NULL, error))
+//     goto out;
+//   ret = TRUE;
+//  out:
+//   g_free (checksum);
+//   g_free (parent);
+//   if (newMetadata)
+//     g_variant_unref (newMetadata);
+//   if (metadata)
+//     g_variant_unref (metadata);
+//   if (root)
+//     g_object_unref (root);
+//   g_variant_unref (commit);
+//   return ret;
+// }
 import "C"
 
 var ostreePrefix = "ociimage"
@@ -179,7 +224,33 @@ func (repo *OSTreeRepo) readMetadata(commit, key string) (bool, string, error) {
 	return false, "", nil
 }
 
-func (repo *OSTreeRepo) unionCheckout(layer string, dirfd int, dest string) error {
+// setMetadata adds a key to the metadata of the commit of a branch.
+// The commit is rewritten with the same tree and the branch is moved
+// to the new commit.
+func (repo *OSTreeRepo) setMetadata(branch, key, value string) error {
+	var cerr *C.GError
+	var ref *C.char
+	defer C.free(unsafe.Pointer(ref))
+
+	cBranch := C.CString(branch)
+	defer C.free(unsafe.Pointer(cBranch))
+
+	if !glib.GoBool(glib.GBoolean(C.ostree_repo_resolve_rev(repo.repo, cBranch, C.gboolean(0), &ref, &cerr))) {
+		return glib.ConvertGError(glib.ToGError(unsafe.Pointer(cerr)))
+	}
+
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+
+	if !glib.GoBool(glib.GBoolean(C.AddCommitMetadata(repo.repo, cBranch, ref, cKey, cValue, &cerr))) {
+		return glib.ConvertGError(glib.ToGError(unsafe.Pointer(cerr)))
+	}
+	return nil
+}
+
+func (repo *OSTreeRepo) unionCheckout(layer string, dirfd int, dest string, user, copy bool) error {
 	var cerr *C.GError
 	var ref *C.char
 	defer C.free(unsafe.Pointer(ref))
@@ -190,7 +261,15 @@ func (repo *OSTreeRepo) unionCheckout(layer string, dirfd int, dest string) erro
 	cDest := C.CString(dest)
 	defer C.free(unsafe.Pointer(cDest))
 
-	options := C.MakeOSTreeCheckoutOptions()
+	var cUser C.int
+	if user {
+		cUser = 1
+	}
+	var cCopy C.int
+	if copy {
+		cCopy = 1
+	}
+	options := C.MakeOSTreeCheckoutOptions(cUser, cCopy)
 	if options == nil {
 		return fmt.Errorf("cannot allocate checkout options")
 	}
@@ -206,6 +285,115 @@ func (repo *OSTreeRepo) unionCheckout(layer string, dirfd int, dest string) erro
 	return nil
 }
 
+// layerFile returns the file at path in the tree of a layer, without
+// checking it out.  It is nil when the layer has no such file.
+func (repo *OSTreeRepo) layerFile(layer, path string) (*C.GFile, error) {
+	var cerr *C.GError
+	var root *C.GFile
+
+	cBranch := C.CString(fmt.Sprintf("%s/%s", ostreePrefix, layer))
+	defer C.free(unsafe.Pointer(cBranch))
+
+	if !glib.GoBool(glib.GBoolean(C.ostree_repo_read_commit(repo.repo, cBranch, &root, nil, nil, &cerr))) {
+		return nil, glib.ConvertGError(glib.ToGError(unsafe.Pointer(cerr)))
+	}
+	path = strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	if path == "" {
+		return root, nil
+	}
+	defer C.g_object_unref(C.gpointer(root))
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	file := C.g_file_resolve_relative_path(root, cPath)
+	if C.g_file_query_file_type(file, C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil) == C.G_FILE_TYPE_UNKNOWN {
+		C.g_object_unref(C.gpointer(file))
+		return nil, nil
+	}
+	return file, nil
+}
+
+func walkTree(dir *C.GFile, rel string, fn func(path string, isDir bool) error) error {
+	var cerr *C.GError
+
+	cAttributes := C.CString("standard::name,standard::type")
+	defer C.free(unsafe.Pointer(cAttributes))
+
+	enumerator := C.g_file_enumerate_children(dir, cAttributes, C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil, &cerr)
+	if enumerator == nil {
+		return glib.ConvertGError(glib.ToGError(unsafe.Pointer(cerr)))
+	}
+	defer C.g_object_unref(C.gpointer(enumerator))
+
+	for {
+		info := C.g_file_enumerator_next_file(enumerator, nil, &cerr)
+		if info == nil {
+			if cerr != nil {
+				return glib.ConvertGError(glib.ToGError(unsafe.Pointer(cerr)))
+			}
+			return nil
+		}
+		name := C.GoString((*C.char)(C.g_file_info_get_name(info)))
+		isDir := C.g_file_info_get_file_type(info) == C.G_FILE_TYPE_DIRECTORY
+		C.g_object_unref(C.gpointer(info))
+
+		path := filepath.Join(rel, name)
+		if err := fn(path, isDir); err != nil {
+			if err == filepath.SkipDir && isDir {
+				continue
+			}
+			return err
+		}
+		if !isDir {
+			continue
+		}
+		cName := C.CString(name)
+		child := C.g_file_get_child(dir, cName)
+		C.free(unsafe.Pointer(cName))
+		err := walkTree(child, path, fn)
+		C.g_object_unref(C.gpointer(child))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// walkLayer calls fn for each entry under dir in the tree of a layer,
+// with its path relative to the root of the layer, without checking
+// the layer out.  Returning filepath.SkipDir for a directory skips its
+// content.  A missing dir has no entries.
+func (repo *OSTreeRepo) walkLayer(layer, dir string, fn func(path string, isDir bool) error) error {
+	file, err := repo.layerFile(layer, dir)
+	if err != nil || file == nil {
+		return err
+	}
+	defer C.g_object_unref(C.gpointer(file))
+	if C.g_file_query_file_type(file, C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil) != C.G_FILE_TYPE_DIRECTORY {
+		return nil
+	}
+	return walkTree(file, strings.TrimPrefix(filepath.Clean("/"+dir), "/"), fn)
+}
+
+// readLayerFile reads a file of a layer without checking the layer
+// out.  found is false when the layer has no such file.
+func (repo *OSTreeRepo) readLayerFile(layer, path string) ([]byte, bool, error) {
+	var cerr *C.GError
+
+	file, err := repo.layerFile(layer, path)
+	if err != nil || file == nil {
+		return nil, false, err
+	}
+	defer C.g_object_unref(C.gpointer(file))
+
+	var contents *C.char
+	var length C.gsize
+	if !glib.GoBool(glib.GBoolean(C.g_file_load_contents(file, nil, &contents, &length, nil, &cerr))) {
+		return nil, true, glib.ConvertGError(glib.ToGError(unsafe.Pointer(cerr)))
+	}
+	defer C.g_free(C.gpointer(contents))
+	return C.GoBytes(unsafe.Pointer(contents), C.int(length)), true, nil
+}
+
 func (repo *OSTreeRepo) getBranches(prefix string) (map[string]string, error) {
 	var cerr *C.GError
 
@@ -251,6 +439,39 @@ func (repo *OSTreeRepo) deleteBranch(branch string) error {
 	return nil
 }
 
+// reachableObjects returns the storage size of the objects used by a
+// commit, indexed by checksum and object type.
+func (repo *OSTreeRepo) reachableObjects(commit string) (map[string]uint64, error) {
+	var cerr *C.GError
+
+	cCommit := C.CString(commit)
+	defer C.free(unsafe.Pointer(cCommit))
+
+	var h *C.GHashTable
+	if !glib.GoBool(glib.GBoolean(C.ostree_repo_traverse_commit(repo.repo, cCommit, 0, &h, nil, &cerr))) {
+		return nil, glib.ConvertGError(glib.ToGError(unsafe.Pointer(cerr)))
+	}
+	defer C.g_hash_table_unref(h)
+
+	var hashIter C.GHashTableIter
+	var key, value C.gpointer
+
+	ret := make(map[string]uint64)
+	C.g_hash_table_iter_init(&hashIter, h)
+	for glib.GoBool(glib.GBoolean(C.g_hash_table_iter_next(&hashIter, &key, &value))) {
+		var checksum *C.char
+		var objType C.OstreeObjectType
+		C.ostree_object_name_deserialize((*C.GVariant)(key), &checksum, &objType)
+
+		var size C.guint64
+		if !glib.GoBool(glib.GBoolean(C.ostree_repo_query_object_storage_size(repo.repo, objType, checksum, &size, nil, &cerr))) {
+			return nil, glib.ConvertGError(glib.ToGError(unsafe.Pointer(cerr)))
+		}
+		ret[fmt.Sprintf("%s.%d", C.GoString(checksum), int(objType))] = uint64(size)
+	}
+	return ret, nil
+}
+
 func (repo *OSTreeRepo) prune() (uint64, error) {
 	var cerr *C.GError
 
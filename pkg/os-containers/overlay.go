@@ -0,0 +1,256 @@
+package oscontainers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/selinux/go-selinux/label"
+	"github.com/pkg/errors"
+)
+
+const overlayDropIn = "os-container-overlay.conf"
+
+// systemdEscapePath escapes a path as systemd-escape --path does, to
+// get the name of its mount unit.
+func systemdEscapePath(p string) string {
+	p = strings.Trim(filepath.Clean(p), "/")
+	if p == "" {
+		return "-"
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+func isMountPoint(path string) bool {
+	var st, parent syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return false
+	}
+	if err := syscall.Lstat(filepath.Dir(path), &parent); err != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+// removeDeployment deletes a deployment directory, the rootfs of an
+// overlay deployment is unmounted first so that the files of the
+// layer cache are never deleted through it.
+func removeDeployment(dir string) error {
+	rootfs := filepath.Join(dir, "rootfs")
+	if isMountPoint(rootfs) {
+		if err := syscall.Unmount(rootfs, 0); err != nil {
+			return errors.Wrapf(err, "unmount %s", rootfs)
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// cachedLayer checks out a layer in the layer cache, unless it is
+// already there, and returns its path.  The cached layers are only
+// used as lower directories, so they are never modified.
+func (m *Manager) cachedLayer(repo *OSTreeRepo, layer string) (string, error) {
+	dest := filepath.Join(m.layersPath, layer)
+	if _, err := os.Stat(dest); err == nil {
+		return dest, nil
+	}
+	if err := os.MkdirAll(m.layersPath, 0700); err != nil {
+		return "", errors.Wrapf(err, "create %s", m.layersPath)
+	}
+	tmpDir, err := ioutil.TempDir(m.layersPath, ".tmp-")
+	if err != nil {
+		return "", errors.Wrapf(err, "create temporary directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpLayer := filepath.Join(tmpDir, "layer")
+	if err := m.checkoutLayer(repo, layer, tmpLayer, false); err != nil {
+		return "", err
+	}
+	whiteouts, err := readWhiteouts(tmpLayer)
+	if err != nil {
+		return "", err
+	}
+	if err := convertWhiteoutsToOverlay(tmpLayer, whiteouts); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpLayer, dest); err != nil {
+		/* Another process cached the same layer.  */
+		if _, err := os.Stat(dest); err == nil {
+			return dest, nil
+		}
+		return "", errors.Wrapf(err, "rename %s", tmpLayer)
+	}
+	m.logger.Printf("cached layer %s\n", layer)
+	return dest, nil
+}
+
+// overlayMountOptions returns the overlayfs options for a deployment,
+// with the paths of the target system when target is set.  The whole
+// mount gets mountLabel, as the cached layers are shared.
+func (m *Manager) overlayMountOptions(destDir string, layers []string, mountLabel string, target bool) string {
+	path := func(p string) string {
+		if target {
+			return m.stripRoot(p)
+		}
+		return p
+	}
+	/* The upper layer comes first for overlayfs.  */
+	var lower []string
+	for i := len(layers) - 1; i >= 0; i-- {
+		lower = append(lower, path(filepath.Join(m.layersPath, layers[i])))
+	}
+	upper := path(filepath.Join(destDir, "overlay/upper"))
+	work := path(filepath.Join(destDir, "overlay/work"))
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lower, ":"), upper, work)
+	return label.FormatMountLabel(options, mountLabel)
+}
+
+func (m *Manager) mountOverlay(destDir string, layers []string, mountLabel string) error {
+	rootfs := filepath.Join(destDir, "rootfs")
+	if isMountPoint(rootfs) {
+		return nil
+	}
+	for _, d := range []string{rootfs, filepath.Join(destDir, "overlay/upper"), filepath.Join(destDir, "overlay/work")} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return errors.Wrapf(err, "create %s", d)
+		}
+	}
+	options := m.overlayMountOptions(destDir, layers, mountLabel, false)
+	if err := syscall.Mount("overlay", rootfs, "overlay", 0, options); err != nil {
+		return errors.Wrapf(err, "mount the overlay on %s", rootfs)
+	}
+	return nil
+}
+
+// checkoutOverlay caches the layers and mounts them with overlayfs on
+// destDir/rootfs, the changes done by the container are stored in
+// destDir/overlay/upper.
+func (m *Manager) checkoutOverlay(repo *OSTreeRepo, layers []string, destDir, mountLabel string) error {
+	if err := removeDeployment(destDir); err != nil {
+		return errors.Wrapf(err, "delete %s", destDir)
+	}
+	for _, l := range layers {
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := m.cachedLayer(repo, l); err != nil {
+			return err
+		}
+	}
+	return m.mountOverlay(destDir, layers, mountLabel)
+}
+
+func (m *Manager) overlayMountUnit(destDir string) string {
+	return systemdEscapePath(m.stripRoot(filepath.Join(destDir, "rootfs"))) + ".mount"
+}
+
+// activateOverlay installs and enables the mount unit for the rootfs
+// of an overlay deployment.  The service of the container requires the
+// mount through a drop-in.
+func (m *Manager) activateOverlay(c *Container, destDir string) error {
+	rootfs := m.stripRoot(filepath.Join(destDir, "rootfs"))
+	unit := m.overlayMountUnit(destDir)
+	content := fmt.Sprintf(`[Unit]
+Description=Root filesystem of the container %s
+
+[Mount]
+What=overlay
+Where=%s
+Type=overlay
+Options=%s
+
+[Install]
+WantedBy=local-fs.target
+`, c.Name, rootfs, m.overlayMountOptions(destDir, c.Layers, c.MountLabel, true))
+	unitFile := filepath.Join(m.unitsPath, unit)
+	if err := ioutil.WriteFile(unitFile, []byte(content), 0644); err != nil {
+		return errors.Wrapf(err, "write %s", unitFile)
+	}
+
+	if c.HasContainerService {
+		dropInDir := filepath.Join(m.unitsPath, fmt.Sprintf("%s.service.d", c.Name))
+		if err := os.MkdirAll(dropInDir, 0755); err != nil {
+			return errors.Wrapf(err, "create %s", dropInDir)
+		}
+		dropIn := filepath.Join(dropInDir, overlayDropIn)
+		content := fmt.Sprintf("[Unit]\nRequiresMountsFor=%s\n", rootfs)
+		if err := ioutil.WriteFile(dropIn, []byte(content), 0644); err != nil {
+			return errors.Wrapf(err, "write %s", dropIn)
+		}
+	}
+
+	if m.root == "" {
+		if _, err := m.systemctlCommand("daemon-reload", "", false, false); err != nil {
+			return err
+		}
+	}
+	return m.enableUnitFile(unit, false)
+}
+
+// deactivateOverlay stops and removes the mount unit of an overlay
+// deployment.
+func (m *Manager) deactivateOverlay(c *Container, destDir string) {
+	unit := m.overlayMountUnit(destDir)
+	m.disableUnitFile(unit)
+	os.Remove(filepath.Join(m.unitsPath, unit))
+	dropInDir := filepath.Join(m.unitsPath, fmt.Sprintf("%s.service.d", c.Name))
+	os.Remove(filepath.Join(dropInDir, overlayDropIn))
+	os.Remove(dropInDir)
+	if rootfs := filepath.Join(destDir, "rootfs"); isMountPoint(rootfs) {
+		if err := syscall.Unmount(rootfs, 0); err != nil {
+			m.logger.Printf("could not unmount %s: %v\n", rootfs, err)
+		}
+	}
+}
+
+// pruneLayerCache deletes the cached layers that no deployment uses.
+func (m *Manager) pruneLayerCache() error {
+	cached, err := ioutil.ReadDir(m.layersPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "read %s", m.layersPath)
+	}
+
+	deployments, err := readDeployments(m.checkoutsPath)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, c := range deployments {
+		for _, l := range c.Layers {
+			used[l] = true
+		}
+	}
+
+	for _, f := range cached {
+		/* Skip the layers being cached.  */
+		if used[f.Name()] || strings.HasPrefix(f.Name(), ".tmp-") {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(m.layersPath, f.Name())); err != nil {
+			return errors.Wrapf(err, "delete the cached layer %s", f.Name())
+		}
+		m.logger.Printf("cached layer %s: delete", f.Name())
+	}
+	return nil
+}
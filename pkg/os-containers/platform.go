@@ -0,0 +1,176 @@
+package oscontainers
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/containers/image/docker"
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+/* Commit metadata key where the platform of a pulled image is stored.  */
+const platformMetadataKey = "os-container.platform"
+
+// Platform identifies the OS and the architecture an image is built for.
+// An empty field matches any value.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// ParsePlatform parses a platform in the OS/ARCH[/VARIANT] form.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %s", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func hostPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+/* The variant is not known for the host, so it is not compared.  */
+func (p Platform) matchesHost() bool {
+	host := hostPlatform()
+	return p.OS == host.OS && p.Architecture == host.Architecture
+}
+
+func (p Platform) matches(wanted Platform) bool {
+	if wanted.OS != "" && p.OS != wanted.OS {
+		return false
+	}
+	if wanted.Architecture != "" && p.Architecture != wanted.Architecture {
+		return false
+	}
+	return wanted.Variant == "" || p.Variant == wanted.Variant
+}
+
+type platformManifest struct {
+	Digest   digest.Digest `json:"digest"`
+	Platform Platform      `json:"platform"`
+}
+
+type platformManifestList struct {
+	Manifests []platformManifest `json:"manifests"`
+}
+
+// selectPlatformImage returns a reference to the image for the wanted
+// platform when srcRef is a manifest list, the fields not specified in
+// wanted default to the host platform.  The returned platform is nil
+// when srcRef is not a manifest list.
+func (m *Manager) selectPlatformImage(srcRef types.ImageReference, sys *types.SystemContext, wanted Platform) (types.ImageReference, *Platform, error) {
+	named := srcRef.DockerReference()
+	if srcRef.Transport().Name() != "docker" || named == nil {
+		return srcRef, nil, nil
+	}
+
+	src, err := srcRef.NewImageSource(m.ctx, sys)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "open image %s", named.String())
+	}
+	defer src.Close()
+
+	blob, mimeType, err := src.GetManifest(m.ctx, nil)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "read manifest for %s", named.String())
+	}
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return srcRef, nil, nil
+	}
+
+	var list platformManifestList
+	if err := json.Unmarshal(blob, &list); err != nil {
+		return nil, nil, errors.Wrapf(err, "unmarshal manifest list for %s", named.String())
+	}
+
+	host := hostPlatform()
+	setIfNotEmpty(&host.OS, wanted.OS)
+	setIfNotEmpty(&host.Architecture, wanted.Architecture)
+	host.Variant = wanted.Variant
+	wanted = host
+
+	var available []string
+	for _, i := range list.Manifests {
+		if !i.Platform.matches(wanted) {
+			available = append(available, i.Platform.String())
+			continue
+		}
+		digested, err := reference.WithDigest(reference.TrimNamed(named), i.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		ref, err := docker.NewReference(digested)
+		if err != nil {
+			return nil, nil, err
+		}
+		platform := i.Platform
+		return ref, &platform, nil
+	}
+	return nil, nil, fmt.Errorf("no image for the platform %s in %s, available: %s", wanted, named.String(), strings.Join(available, ", "))
+}
+
+// imagePlatform returns the platform recorded when the image was
+// pulled.  For images pulled by older versions, the platform is read
+// from the image configuration.
+func (m *Manager) imagePlatform(repo *OSTreeRepo, srcRef types.ImageReference, branch string) (Platform, error) {
+	found, value, err := repo.readMetadata(branch, platformMetadataKey)
+	if err != nil {
+		return Platform{}, err
+	}
+	if found {
+		return ParsePlatform(value)
+	}
+
+	ostreeRef, err := getOSTreeReference(srcRef, m.repoPath)
+	if err != nil {
+		return Platform{}, err
+	}
+	img, err := ostreeRef.NewImage(m.ctx, nil)
+	if err != nil {
+		return Platform{}, errors.Wrapf(err, "open image %s", branch)
+	}
+	defer img.Close()
+	info, err := img.Inspect(m.ctx)
+	if err != nil {
+		return Platform{}, errors.Wrapf(err, "inspect image %s", branch)
+	}
+	return Platform{OS: info.Os, Architecture: info.Architecture}, nil
+}
+
+// checkImagePlatform fails when the image is built for another platform
+// than the host, unless force is set.
+func (m *Manager) checkImagePlatform(repo *OSTreeRepo, srcRef types.ImageReference, branch string, force bool) error {
+	platform, err := m.imagePlatform(repo, srcRef, branch)
+	if err != nil {
+		return err
+	}
+	if platform.OS == "" || platform.matchesHost() {
+		return nil
+	}
+	name := srcRef.DockerReference().String()
+	if !force {
+		return fmt.Errorf("the image %s is built for %s while the host is %s, use --force to install it anyway", name, platform, hostPlatform())
+	}
+	m.logger.Printf("warning: the image %s is built for %s while the host is %s\n", name, platform, hostPlatform())
+	return nil
+}
@@ -0,0 +1,222 @@
+package oscontainers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/image/docker/reference"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+const systemPolicyFile = "/etc/containers/os-containers-policy.conf"
+
+// containerPolicy are the rules for what the containers may do.  A rule
+// that is not set doesn't restrict anything.
+type containerPolicy struct {
+	// Registries are the registries, or the repositories, that the
+	// images can be installed from.
+	Registries *[]string `toml:"registries"`
+	// HostFiles are the path prefixes where the images can install
+	// files with exports/hostfs.
+	HostFiles *[]string `toml:"host_files"`
+	// Privileged allows the containers with CAP_SYS_ADMIN or with
+	// access to all the devices.
+	Privileged *bool `toml:"privileged"`
+	// HostPID allows the containers to share the PID namespace of the
+	// host.
+	HostPID *bool `toml:"host_pid"`
+}
+
+// adminPolicy is the content of the policy file.  The rules set for a
+// container in Containers replace the global ones.
+type adminPolicy struct {
+	containerPolicy
+	Containers map[string]containerPolicy `toml:"containers"`
+
+	path string
+}
+
+// readAdminPolicy reads the policy file, a missing file allows
+// everything.
+func readAdminPolicy(path string) (*adminPolicy, error) {
+	var p adminPolicy
+	meta, err := toml.DecodeFile(path, &p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read the policy %s", path)
+	}
+	/* A misspelled rule would be silently ignored.  */
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		var keys []string
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		return nil, fmt.Errorf("unknown keys in the policy %s: %s", path, strings.Join(keys, ", "))
+	}
+	p.path = path
+	return &p, nil
+}
+
+func (p *adminPolicy) forContainer(name string) containerPolicy {
+	ret := p.containerPolicy
+	exception, ok := p.Containers[name]
+	if !ok {
+		return ret
+	}
+	if exception.Registries != nil {
+		ret.Registries = exception.Registries
+	}
+	if exception.HostFiles != nil {
+		ret.HostFiles = exception.HostFiles
+	}
+	if exception.Privileged != nil {
+		ret.Privileged = exception.Privileged
+	}
+	if exception.HostPID != nil {
+		ret.HostPID = exception.HostPID
+	}
+	return ret
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	path = filepath.Clean(path)
+	prefix = filepath.Clean(prefix)
+	return prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func policyImageViolations(rules containerPolicy, ref reference.Named) []string {
+	if rules.Registries == nil {
+		return nil
+	}
+	name := ref.Name()
+	for _, r := range *rules.Registries {
+		r = strings.TrimSuffix(r, "/")
+		if name == r || strings.HasPrefix(name, r+"/") {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("the image %s is not from an approved registry", ref.String())}
+}
+
+func privilegedReasons(spec *rspec.Spec) []string {
+	var ret []string
+	if spec.Process != nil && spec.Process.Capabilities != nil {
+		c := spec.Process.Capabilities
+		var all []string
+		for _, caps := range [][]string{c.Bounding, c.Effective, c.Permitted, c.Inheritable, c.Ambient} {
+			all = append(all, caps...)
+		}
+		for _, cap := range all {
+			if cap == "CAP_SYS_ADMIN" {
+				ret = append(ret, "it has the capability CAP_SYS_ADMIN")
+				break
+			}
+		}
+	}
+	if spec.Linux != nil && spec.Linux.Resources != nil {
+		for _, d := range spec.Linux.Resources.Devices {
+			if d.Allow && (d.Type == "" || d.Type == "a") && d.Major == nil && d.Minor == nil {
+				ret = append(ret, "it can access all the devices")
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func sharesHostPID(spec *rspec.Spec) bool {
+	if spec.Linux == nil {
+		return true
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == rspec.PIDNamespace {
+			return ns.Path != ""
+		}
+	}
+	return true
+}
+
+// report returns the error for the violations of the policy.
+func (p *adminPolicy) report(name string, violations []string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "the container %s is not allowed by the policy %s:", name, p.path)
+	for _, v := range violations {
+		fmt.Fprintf(&b, "\n  - %s", v)
+	}
+	return errors.New(b.String())
+}
+
+// checkImagePolicy checks that the policy allows the image of a
+// container, before it is pulled.
+func (m *Manager) checkImagePolicy(name string, ref reference.Named) error {
+	if m.adminPolicy == nil {
+		return nil
+	}
+	if violations := policyImageViolations(m.adminPolicy.forContainer(name), ref); len(violations) > 0 {
+		return m.adminPolicy.report(name, violations)
+	}
+	return nil
+}
+
+// checkDeploymentPolicy checks the OCI configuration of the deployment
+// in destDir and the files it installs on the host against the policy.
+func (m *Manager) checkDeploymentPolicy(name, destDir string, c *Container) error {
+	if m.adminPolicy == nil {
+		return nil
+	}
+	rules := m.adminPolicy.forContainer(name)
+
+	configFile := filepath.Join(destDir, "config.json")
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open file %s", configFile)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return errors.Wrapf(err, "unmarshal container %s conf file", configFile)
+	}
+
+	var violations []string
+	if rules.Privileged != nil && !*rules.Privileged {
+		for _, r := range privilegedReasons(&spec) {
+			violations = append(violations, fmt.Sprintf("the container is privileged: %s", r))
+		}
+	}
+	if rules.HostPID != nil && !*rules.HostPID && sharesHostPID(&spec) {
+		violations = append(violations, "the container shares the PID namespace of the host")
+	}
+	if rules.HostFiles != nil && !m.rootless {
+		plan, err := hostFilesPlan(filepath.Join(destDir, "rootfs/exports/hostfs"), "/", c)
+		if err != nil {
+			return err
+		}
+		for _, f := range plan {
+			if f.IsDir {
+				continue
+			}
+			allowed := false
+			for _, prefix := range *rules.HostFiles {
+				if hasPathPrefix(f.Installed, prefix) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				violations = append(violations, fmt.Sprintf("the file %s is installed outside of the allowed paths", f.Installed))
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return m.adminPolicy.report(name, violations)
+	}
+	return nil
+}
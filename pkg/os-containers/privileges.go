@@ -0,0 +1,280 @@
+package oscontainers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	selinux "github.com/opencontainers/selinux/go-selinux"
+	"github.com/pkg/errors"
+)
+
+// PrivilegeSummary lists what a deployment can do on the host.
+type PrivilegeSummary struct {
+	// HostNamespaces are the namespaces shared with the host, or
+	// joined from another process.
+	HostNamespaces []string `json:"hostNamespaces"`
+	Capabilities   []string `json:"capabilities"`
+	// HostMounts are the paths of the host bind mounted in the
+	// container, in the SOURCE:DESTINATION[:ro] form.
+	HostMounts []string `json:"hostMounts"`
+	// Devices are the devices created in the container and the
+	// device cgroup rules that allow an access.
+	Devices []string `json:"devices"`
+	// Unconfined are the security modules that don't confine the
+	// container.
+	Unconfined []string `json:"unconfined"`
+	// HostFiles are the files written on the host.
+	HostFiles []string `json:"hostFiles"`
+	// Units are the systemd units installed.
+	Units []string `json:"units"`
+}
+
+// ConfirmFunc is called when the privileges of a container grow, with
+// all the privileges of the new deployment and the ones that the
+// previous deployment didn't have.  The operation is done only if it
+// returns true.
+type ConfirmFunc func(summary, added *PrivilegeSummary) (bool, error)
+
+// isolatingNamespaces are the namespaces that isolate a container from
+// the host.  The user and the cgroup namespaces are not used by
+// default, so they are not reported.
+var isolatingNamespaces = []rspec.LinuxNamespaceType{
+	rspec.PIDNamespace,
+	rspec.NetworkNamespace,
+	rspec.IPCNamespace,
+	rspec.UTSNamespace,
+	rspec.MountNamespace,
+}
+
+func sortedUnique(items []string) []string {
+	seen := make(map[string]bool)
+	ret := []string{}
+	for _, i := range items {
+		if !seen[i] {
+			seen[i] = true
+			ret = append(ret, i)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func isBindMount(mount rspec.Mount) bool {
+	if mount.Type == "bind" {
+		return true
+	}
+	for _, o := range mount.Options {
+		if o == "bind" || o == "rbind" {
+			return true
+		}
+	}
+	return false
+}
+
+func deviceRule(d rspec.LinuxDeviceCgroup) string {
+	number := func(n *int64) string {
+		if n == nil {
+			return "*"
+		}
+		return fmt.Sprintf("%d", *n)
+	}
+	devType := d.Type
+	if devType == "" {
+		devType = "a"
+	}
+	return fmt.Sprintf("%s %s:%s %s", devType, number(d.Major), number(d.Minor), d.Access)
+}
+
+func specPrivileges(spec *rspec.Spec, s *PrivilegeSummary) {
+	if spec.Linux != nil {
+		for _, t := range isolatingNamespaces {
+			found := false
+			for _, ns := range spec.Linux.Namespaces {
+				if ns.Type != t {
+					continue
+				}
+				found = true
+				if ns.Path != "" {
+					s.HostNamespaces = append(s.HostNamespaces, fmt.Sprintf("%s (%s)", t, ns.Path))
+				}
+			}
+			if !found {
+				s.HostNamespaces = append(s.HostNamespaces, string(t))
+			}
+		}
+		for _, d := range spec.Linux.Devices {
+			s.Devices = append(s.Devices, d.Path)
+		}
+		if spec.Linux.Resources != nil {
+			for _, d := range spec.Linux.Resources.Devices {
+				if d.Allow {
+					s.Devices = append(s.Devices, deviceRule(d))
+				}
+			}
+		}
+		if spec.Linux.Seccomp == nil {
+			s.Unconfined = append(s.Unconfined, "seccomp")
+		}
+	} else {
+		for _, t := range isolatingNamespaces {
+			s.HostNamespaces = append(s.HostNamespaces, string(t))
+		}
+		s.Unconfined = append(s.Unconfined, "seccomp")
+	}
+
+	if spec.Process != nil {
+		if c := spec.Process.Capabilities; c != nil {
+			for _, caps := range [][]string{c.Bounding, c.Effective, c.Permitted, c.Inheritable, c.Ambient} {
+				s.Capabilities = append(s.Capabilities, caps...)
+			}
+		}
+		if apparmorEnabled() && spec.Process.ApparmorProfile == "" {
+			s.Unconfined = append(s.Unconfined, "apparmor")
+		}
+		if selinux.GetEnabled() && spec.Process.SelinuxLabel == "" {
+			s.Unconfined = append(s.Unconfined, "selinux")
+		}
+	}
+
+	for _, mount := range spec.Mounts {
+		if !isBindMount(mount) {
+			continue
+		}
+		m := fmt.Sprintf("%s:%s", mount.Source, mount.Destination)
+		for _, o := range mount.Options {
+			if o == "ro" {
+				m = m + ":ro"
+			}
+		}
+		s.HostMounts = append(s.HostMounts, m)
+	}
+}
+
+// privilegeSummary computes the privileges of the deployment in destDir
+// from its OCI configuration and from the files that it installs.
+func (m *Manager) privilegeSummary(destDir string, c *Container) (*PrivilegeSummary, error) {
+	configFile := filepath.Join(destDir, "config.json")
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open file %s", configFile)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal container %s conf file", configFile)
+	}
+
+	s := &PrivilegeSummary{}
+	specPrivileges(&spec, s)
+
+	/* The paths in the deployment are reported through the symlink to
+	   the active deployment, so that they compare equal across
+	   updates.  */
+	active := filepath.Join(filepath.Dir(destDir), c.Name)
+	replacer := strings.NewReplacer(m.stripRoot(destDir), m.stripRoot(active))
+	for i := range s.HostMounts {
+		s.HostMounts[i] = replacer.Replace(s.HostMounts[i])
+	}
+
+	if !m.rootless {
+		plan, err := hostFilesPlan(filepath.Join(destDir, "rootfs/exports/hostfs"), "/", c)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range plan {
+			if f.IsDir {
+				continue
+			}
+			s.HostFiles = append(s.HostFiles, f.Installed)
+			/* Units and drop-ins copied in a systemd directory.  */
+			if strings.Contains(f.Installed, "/systemd/") {
+				s.Units = append(s.Units, f.Installed)
+			}
+		}
+	}
+	if c.HasContainerService {
+		s.Units = append(s.Units, m.stripRoot(filepath.Join(m.unitsPath, fmt.Sprintf("%s.service", c.Name))))
+		tmpFiles := filepath.Join(destDir, fmt.Sprintf("tmpfiles-%s.conf", c.Name))
+		if _, err := os.Stat(tmpFiles); err == nil {
+			s.HostFiles = append(s.HostFiles, m.stripRoot(filepath.Join(m.tmpFilesPath, filepath.Base(tmpFiles))))
+		}
+	}
+	if c.Overlay {
+		s.Units = append(s.Units, m.stripRoot(filepath.Join(m.unitsPath, m.overlayMountUnit(active))))
+	}
+
+	s.HostNamespaces = sortedUnique(s.HostNamespaces)
+	s.Capabilities = sortedUnique(s.Capabilities)
+	s.HostMounts = sortedUnique(s.HostMounts)
+	s.Devices = sortedUnique(s.Devices)
+	s.Unconfined = sortedUnique(s.Unconfined)
+	s.HostFiles = sortedUnique(s.HostFiles)
+	s.Units = sortedUnique(s.Units)
+	return s, nil
+}
+
+func notIn(items, previous []string) []string {
+	had := make(map[string]bool)
+	for _, p := range previous {
+		had[p] = true
+	}
+	ret := []string{}
+	for _, i := range items {
+		if !had[i] {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// Added returns the privileges of s that previous doesn't have.
+// previous is nil for a new container.
+func (s *PrivilegeSummary) Added(previous *PrivilegeSummary) *PrivilegeSummary {
+	if previous == nil {
+		previous = &PrivilegeSummary{}
+	}
+	return &PrivilegeSummary{
+		HostNamespaces: notIn(s.HostNamespaces, previous.HostNamespaces),
+		Capabilities:   notIn(s.Capabilities, previous.Capabilities),
+		HostMounts:     notIn(s.HostMounts, previous.HostMounts),
+		Devices:        notIn(s.Devices, previous.Devices),
+		Unconfined:     notIn(s.Unconfined, previous.Unconfined),
+		HostFiles:      notIn(s.HostFiles, previous.HostFiles),
+		Units:          notIn(s.Units, previous.Units),
+	}
+}
+
+// IsEmpty tells whether s lists no privilege.
+func (s *PrivilegeSummary) IsEmpty() bool {
+	return len(s.HostNamespaces) == 0 && len(s.Capabilities) == 0 && len(s.HostMounts) == 0 &&
+		len(s.Devices) == 0 && len(s.Unconfined) == 0 && len(s.HostFiles) == 0 && len(s.Units) == 0
+}
+
+// confirmPrivileges asks confirm when the deployment in destDir has more
+// privileges than previous, nil for a new container.
+func (m *Manager) confirmPrivileges(confirm ConfirmFunc, destDir string, c *Container, previous *PrivilegeSummary) error {
+	if confirm == nil {
+		return nil
+	}
+	summary, err := m.privilegeSummary(destDir, c)
+	if err != nil {
+		return err
+	}
+	added := summary.Added(previous)
+	if added.IsEmpty() {
+		return nil
+	}
+	ok, err := confirm(summary, added)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("the privileges of the container %s were not confirmed", c.Name)
+	}
+	return nil
+}
@@ -1,48 +1,23 @@
 package oscontainers
 
 import (
-	"context"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/containers/image/copy"
 	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/docker/tarfile"
 	"github.com/containers/image/ostree"
 	"github.com/containers/image/signature"
-	"github.com/containers/image/transports/alltransports"
 	"github.com/containers/image/types"
 	"github.com/ostreedev/ostree-go/pkg/otbuiltin"
 	"github.com/pkg/errors"
 )
 
-func getStoragePath() string {
-	if os.Geteuid() != 0 {
-		dataDir := os.Getenv("XDG_DATA_HOME")
-		if dataDir == "" {
-			home := os.Getenv("HOME")
-			resolvedHome, err := filepath.EvalSymlinks(home)
-			if err == nil {
-				home = resolvedHome
-			}
-			dataDir = filepath.Join(home, ".local", "share")
-		}
-		return filepath.Join(dataDir, "containers/atomic/.storage")
-	}
-	return "/var/lib/containers/atomic/.storage"
-}
-
-func getOSTreeRepo() string {
-	repo := os.Getenv("OSTREE_REPO")
-	if repo != "" {
-		return repo
-	}
-	return filepath.Join(getStoragePath(), "repo")
-}
-
-func ensureRepoExists(repoLocation string) error {
+func ensureRepoExists(repoLocation string, rootless bool) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
@@ -55,7 +30,7 @@ func ensureRepoExists(repoLocation string) error {
 		}
 
 		init := otbuiltin.NewInitOptions()
-		if os.Geteuid() != 0 {
+		if rootless {
 			init.Mode = "bare-user"
 		}
 
@@ -76,7 +51,7 @@ func getOSTreeReference(image types.ImageReference, repo string) (types.ImageRef
 			if err != nil {
 				return nil, err
 			}
-			for _, i := range(manifest) {
+			for _, i := range manifest {
 				if i.RepoTags != nil {
 					return ostree.NewReference(i.RepoTags[0], repo)
 				}
@@ -95,38 +70,119 @@ func getOSTreeReference(image types.ImageReference, repo string) (types.ImageRef
 	return ostree.NewReference(ref.Name(), repo)
 }
 
-func PullImage(insecure bool, image string) error {
-	repo := getOSTreeRepo()
+func (m *Manager) getPolicyContext() (*signature.PolicyContext, error) {
+	policy, err := signature.DefaultPolicy(&types.SystemContext{
+		SignaturePolicyPath: m.policyPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signature.NewPolicyContext(policy)
+}
 
-	if err := ensureRepoExists(repo); err != nil {
-		return err
+func (m *Manager) isInsecureRegistry(ref types.ImageReference) bool {
+	dockerRef := ref.DockerReference()
+	if dockerRef == nil {
+		return false
+	}
+	domain := reference.Domain(dockerRef)
+	for _, r := range m.insecure {
+		if r == domain {
+			return true
+		}
 	}
+	return false
+}
 
-	policy, err := signature.DefaultPolicy(nil)
-	if err != nil {
-		return err
+func (m *Manager) Pull(insecure bool, image string) error {
+	_, err := m.pullImage(image, PullOptions{Insecure: insecure}, m.output, nil)
+	return err
+}
+
+// pullImage copies an image to the repository and returns its digest.
+// The progress bars are written to reportWriter, when progress is not
+// nil it receives the progress of each layer.
+func (m *Manager) pullImage(image string, opts PullOptions, reportWriter io.Writer, progress chan types.ProgressProperties) (string, error) {
+	repo := m.repoPath
+
+	if err := ensureRepoExists(repo, m.rootless); err != nil {
+		return "", err
 	}
 
-	policyContext, err := signature.NewPolicyContext(policy)
+	policyContext, err := m.getPolicyContext()
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer policyContext.Destroy()
 
-	srcRef, err := alltransports.ParseImageName(image)
+	image, err = m.resolveImageName(image)
 	if err != nil {
-		return fmt.Errorf("Invalid source name %s: %v", image, err)
+		return "", err
+	}
+	srcRef, err := parseImageName(image)
+	if err != nil {
+		return "", fmt.Errorf("Invalid source name %s: %v", image, err)
 	}
 	destRef, err := getOSTreeReference(srcRef, repo)
 	if err != nil {
-		return fmt.Errorf("Invalid destination name %s: %v", image, err)
+		return "", fmt.Errorf("Invalid destination name %s: %v", image, err)
 	}
 
-	destinationCtx := &types.SystemContext{
-		DockerInsecureSkipTLSVerify: insecure,
+	sourceCtx := &types.SystemContext{
+		DockerInsecureSkipTLSVerify: opts.Insecure || m.isInsecureRegistry(srcRef),
+		ArchitectureChoice:          opts.Platform.Architecture,
+		OSChoice:                    opts.Platform.OS,
 	}
 
-	return copy.Image(context.Background(), policyContext, destRef, srcRef, &copy.Options{
-		ReportWriter:   os.Stdout,
-		DestinationCtx: destinationCtx,
-	})
+	/* The variant is not supported by containers/image, so the image
+	   is selected from the manifest list here.  */
+	srcRef, platform, err := m.selectPlatformImage(srcRef, sourceCtx, opts.Platform)
+	if err != nil {
+		return "", err
+	}
+
+	copyOptions := &copy.Options{
+		ReportWriter: reportWriter,
+		SourceCtx:    sourceCtx,
+	}
+	if progress != nil {
+		copyOptions.Progress = progress
+		copyOptions.ProgressInterval = time.Second
+	}
+	lockedRef := lockedCommitReference{ImageReference: destRef, lock: m.repoLock}
+	if err := copy.Image(m.ctx, policyContext, lockedRef, srcRef, copyOptions); err != nil {
+		return "", err
+	}
+
+	/* The metadata rewrites the commit of the branch.  */
+	m.repoLock.Lock()
+	defer m.repoLock.Unlock()
+
+	ostreeRepo, err := openRepo(repo)
+	if err != nil {
+		return "", err
+	}
+	dockerRef := destRef.DockerReference()
+	branch := fmt.Sprintf("%s/%s", ostreePrefix, encodeOStreeRef(dockerRef.String()))
+	_, digest, err := ostreeRepo.readMetadata(branch, "docker.digest")
+	if err != nil {
+		return "", err
+	}
+
+	if platform == nil {
+		p, err := m.imagePlatform(ostreeRepo, destRef, branch)
+		if err != nil {
+			return "", err
+		}
+		platform = &p
+		if !p.matches(opts.Platform) {
+			m.logger.Printf("warning: the image %s is not a manifest list, it is built for %s\n", image, p)
+		}
+	}
+	if platform.OS != "" {
+		if err := ostreeRepo.setMetadata(branch, platformMetadataKey, platform.String()); err != nil {
+			return "", errors.Wrapf(err, "record the platform of %s", image)
+		}
+	}
+	return digest, nil
 }
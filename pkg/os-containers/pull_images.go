@@ -0,0 +1,152 @@
+package oscontainers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containers/image/types"
+)
+
+const maxConcurrentPulls = 3
+
+type PullOptions struct {
+	Insecure bool
+	// Quiet disables the progress output.
+	Quiet bool
+	// JSONProgress writes one JSON object per line for each stage
+	// of the pull and for the progress of each layer.
+	JSONProgress bool
+	// Platform selects the image from a manifest list, the fields
+	// not specified default to the host platform.
+	Platform Platform
+}
+
+type PullResult struct {
+	Image  string
+	Digest string
+	Err    error
+}
+
+type pullEvent struct {
+	Image  string `json:"image"`
+	Stage  string `json:"stage"`
+	Layer  string `json:"layer,omitempty"`
+	Offset uint64 `json:"offset,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type pullEventWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (p *pullEventWriter) write(e pullEvent) {
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	fmt.Fprintln(p.w, string(data))
+}
+
+// lockedCommitReference is an image reference whose destination commits
+// to the repository while holding lock.  The blobs are still fetched
+// concurrently, only the commits are serialized.
+type lockedCommitReference struct {
+	types.ImageReference
+	lock *sync.Mutex
+}
+
+func (r lockedCommitReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return lockedCommitDestination{ImageDestination: dest, lock: r.lock}, nil
+}
+
+type lockedCommitDestination struct {
+	types.ImageDestination
+	lock *sync.Mutex
+}
+
+func (d lockedCommitDestination) Commit(ctx context.Context) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.ImageDestination.Commit(ctx)
+}
+
+func (m *Manager) pullWithEvents(image string, opts PullOptions, events *pullEventWriter) (string, error) {
+	events.write(pullEvent{Image: image, Stage: "start"})
+
+	progress := make(chan types.ProgressProperties)
+	done := make(chan struct{})
+	go func() {
+		for p := range progress {
+			events.write(pullEvent{
+				Image:  image,
+				Stage:  "layer",
+				Layer:  p.Artifact.Digest.String(),
+				Offset: p.Offset,
+				Size:   p.Artifact.Size,
+			})
+		}
+		close(done)
+	}()
+
+	digest, err := m.pullImage(image, opts, nil, progress)
+	close(progress)
+	<-done
+
+	if err != nil {
+		events.write(pullEvent{Image: image, Stage: "error", Error: err.Error()})
+	} else {
+		events.write(pullEvent{Image: image, Stage: "done", Digest: digest})
+	}
+	return digest, err
+}
+
+// PullImages pulls several images concurrently.  The layers already
+// present in the repository are not fetched again.  An error for an
+// image doesn't stop the other pulls, it is reported in its result.
+func (m *Manager) PullImages(images []string, opts PullOptions) []PullResult {
+	results := make([]PullResult, len(images))
+	events := &pullEventWriter{w: m.output}
+
+	/* Progress bars are only readable for a single image.  */
+	var reportWriter io.Writer
+	if !opts.Quiet && !opts.JSONProgress && len(images) == 1 {
+		reportWriter = m.output
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentPulls)
+	for i, image := range images {
+		wg.Add(1)
+		go func(i int, image string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var digest string
+			var err error
+			if opts.JSONProgress {
+				digest, err = m.pullWithEvents(image, opts, events)
+			} else {
+				if reportWriter == nil && !opts.Quiet {
+					m.logger.Printf("pulling %s\n", image)
+				}
+				digest, err = m.pullImage(image, opts, reportWriter, nil)
+			}
+			results[i] = PullResult{Image: image, Digest: digest, Err: err}
+		}(i, image)
+	}
+	wg.Wait()
+	return results
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"os/user"
 
 	"github.com/containers/storage/pkg/idtools"
@@ -13,7 +12,7 @@ import (
 	"github.com/pkg/errors"
 )
 
-func makeOCIConfigurationRootless(path string) error {
+func (m *Manager) makeOCIConfigurationRootless(path string) error {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return errors.Wrapf(err, "cannot open file %s", path)
@@ -43,11 +42,11 @@ func makeOCIConfigurationRootless(path string) error {
 			return err
 		}
 
-		username := os.Getenv("USER")
+		username := m.userName
 		if username == "" {
-			user, err := user.LookupId(fmt.Sprintf("%d", os.Geteuid()))
+			user, err := user.LookupId(fmt.Sprintf("%d", m.uid))
 			if err != nil {
-				return errors.Wrapf(err, "could not find user by UID nor USER env was set")
+				return errors.Wrapf(err, "could not find the user %d", m.uid)
 			}
 			username = user.Username
 		}
@@ -56,12 +55,12 @@ func makeOCIConfigurationRootless(path string) error {
 			return err
 		}
 		g.ClearLinuxUIDMappings()
-		g.AddLinuxUIDMapping(uint32(os.Geteuid()), 0, 1)
+		g.AddLinuxUIDMapping(uint32(m.uid), 0, 1)
 		for _, i := range mappings.UIDs() {
 			g.AddLinuxUIDMapping(uint32(i.HostID), uint32(i.ContainerID+1), uint32(i.Size))
 		}
 		g.ClearLinuxGIDMappings()
-		g.AddLinuxGIDMapping(uint32(os.Getegid()), 0, 1)
+		g.AddLinuxGIDMapping(uint32(m.gid), 0, 1)
 		for _, i := range mappings.GIDs() {
 			g.AddLinuxGIDMapping(uint32(i.HostID), uint32(i.ContainerID+1), uint32(i.Size))
 		}
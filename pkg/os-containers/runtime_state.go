@@ -0,0 +1,134 @@
+package oscontainers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// RuntimeState is the state of a container as reported by the OCI
+// runtime.
+type RuntimeState struct {
+	ID     string `json:"id"`
+	Pid    int    `json:"pid"`
+	Status string `json:"status"`
+	Bundle string `json:"bundle"`
+}
+
+// ContainerState combines the state of the systemd unit with the
+// state known to the OCI runtime.  Runtime is nil when the runtime
+// has no container with that name.  RuntimeError is set instead when
+// the runtime could not be queried, Mismatch is only set when systemd
+// and the runtime disagree.
+type ContainerState struct {
+	Unit         int
+	Runtime      *RuntimeState
+	RuntimeError error
+	Mismatch     string
+}
+
+func (m *Manager) runtimeCommand(runtime string, args ...string) ([]byte, error) {
+	profile, err := m.runtimeProfile(runtime)
+	if err != nil {
+		return nil, err
+	}
+	out, err := m.runtimeExec(profile, args...).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot execute %s %s", profile.Path, args[0])
+	}
+	return out, nil
+}
+
+func (m *Manager) listRuntimeContainers(runtime string) ([]RuntimeState, error) {
+	out, err := m.runtimeCommand(runtime, "list", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var states []RuntimeState
+	if err := json.Unmarshal(out, &states); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal the output of %s list", runtime)
+	}
+	return states, nil
+}
+
+func (m *Manager) runtimeState(c *Container) (*RuntimeState, error) {
+	out, err := m.runtimeCommand(c.Runtime, "state", c.Name)
+	if err == nil {
+		var state RuntimeState
+		if err := json.Unmarshal(out, &state); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal the state of %s", c.Name)
+		}
+		return &state, nil
+	}
+
+	/* state fails also for a missing container, check with list.  */
+	states, listErr := m.listRuntimeContainers(c.Runtime)
+	if listErr != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		if s.ID == c.Name {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (m *Manager) ContainerState(c *Container) (*ContainerState, error) {
+	unit, err := m.ContainerStatus(c)
+	if err != nil {
+		return nil, err
+	}
+	state := &ContainerState{Unit: unit}
+	if m.root != "" {
+		return state, nil
+	}
+
+	state.Runtime, err = m.runtimeState(c)
+	if err != nil {
+		state.RuntimeError = errors.Wrapf(err, "cannot query the runtime")
+		return state, nil
+	}
+
+	switch {
+	case !c.HasContainerService:
+	case unit == Running && state.Runtime == nil:
+		state.Mismatch = "the unit is active but the runtime has no container"
+	case unit == Running && state.Runtime.Status == "stopped":
+		state.Mismatch = "the unit is active but the runtime container is stopped"
+	case unit != Running && state.Runtime != nil:
+		state.Mismatch = fmt.Sprintf("the unit is not active but the runtime container is %s", state.Runtime.Status)
+	}
+	return state, nil
+}
+
+// Cleanup deletes the runtime state left behind by a container whose
+// service is not active.
+func (m *Manager) Cleanup(name string) error {
+	if m.root != "" {
+		return fmt.Errorf("cleanup is not available for an alternate root")
+	}
+	c, err := ReadContainer(m.checkoutsPath, name, nil)
+	if err != nil {
+		return err
+	}
+	if m.isUnitActive(c.Name) {
+		return fmt.Errorf("the service %s is active, stop it first", c.Name)
+	}
+
+	state, err := m.runtimeState(c)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		m.logger.Printf("no runtime state for %s\n", c.Name)
+		return nil
+	}
+
+	m.logger.Printf("%s delete --force %s\n", c.Runtime, c.Name)
+	if _, err := m.runtimeCommand(c.Runtime, "delete", "--force", c.Name); err != nil {
+		return err
+	}
+	return nil
+}
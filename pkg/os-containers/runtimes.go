@@ -0,0 +1,109 @@
+package oscontainers
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const defaultRuntimeName = "runc"
+
+// RuntimeProfile describes how an OCI runtime is invoked.
+type RuntimeProfile struct {
+	// Path is the runtime executable.
+	Path string `toml:"path"`
+	// Args are passed before the runtime command.
+	Args []string `toml:"args"`
+	// Rootless is set when the runtime can run rootless containers.
+	Rootless bool `toml:"rootless"`
+	// SystemdCgroup is set when the runtime accepts --systemd-cgroup.
+	SystemdCgroup bool `toml:"systemd_cgroup"`
+	// PidFile is set when the runtime can run detached and write a
+	// pid file.
+	PidFile bool `toml:"pidfile"`
+}
+
+func builtinRuntimes() map[string]RuntimeProfile {
+	return map[string]RuntimeProfile{
+		"runc": {
+			Path:          "/usr/bin/runc",
+			Rootless:      true,
+			SystemdCgroup: true,
+			PidFile:       true,
+		},
+		"crun": {
+			Path:          "/usr/bin/crun",
+			Rootless:      true,
+			SystemdCgroup: true,
+			PidFile:       true,
+		},
+		"runsc": {
+			Path:    "/usr/bin/runsc",
+			PidFile: true,
+		},
+		"kata": {
+			Path:    "/usr/bin/kata-runtime",
+			PidFile: true,
+		},
+	}
+}
+
+// runtimeProfile looks up a runtime by name.  A path that is not in
+// the registry is accepted as well, and gets the settings of the
+// runtime with the same executable, or with the same executable name,
+// or the ones of runc.  The runtimes are tried in the order of their
+// names, so the choice is the same on every run.
+func (m *Manager) runtimeProfile(runtime string) (*RuntimeProfile, error) {
+	if runtime == "" {
+		runtime = m.runtime
+	}
+	if profile, ok := m.runtimes[runtime]; ok {
+		return &profile, nil
+	}
+	if !strings.Contains(runtime, "/") {
+		return nil, fmt.Errorf("unknown runtime %s", runtime)
+	}
+
+	var names []string
+	for name := range m.runtimes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	profile := builtinRuntimes()[defaultRuntimeName]
+	var sameName *RuntimeProfile
+	found := false
+	for _, name := range names {
+		p := m.runtimes[name]
+		if p.Path == runtime {
+			profile = p
+			found = true
+			break
+		}
+		if sameName == nil && filepath.Base(p.Path) == filepath.Base(runtime) {
+			sameName = &p
+		}
+	}
+	if !found && sameName != nil {
+		profile = *sameName
+	}
+	profile.Path = runtime
+	return &profile, nil
+}
+
+func (m *Manager) checkRuntimeProfile(runtime string) (*RuntimeProfile, error) {
+	profile, err := m.runtimeProfile(runtime)
+	if err != nil {
+		return nil, err
+	}
+	if m.rootless && !profile.Rootless {
+		return nil, fmt.Errorf("the runtime %s doesn't support rootless containers", runtime)
+	}
+	return profile, nil
+}
+
+func (m *Manager) runtimeExec(p *RuntimeProfile, args ...string) *exec.Cmd {
+	return exec.CommandContext(m.ctx, p.Path, append(append([]string{}, p.Args...), args...)...)
+}
@@ -0,0 +1,326 @@
+package oscontainers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/pkg/errors"
+)
+
+/* Where the secrets are found in the container.  */
+const secretsMountPoint = "/run/secrets"
+
+// The drop-in of the service that copies the secrets.
+const secretsDropIn = "os-container-secrets.conf"
+
+var secretNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (m *Manager) secretsDir(container string) string {
+	return filepath.Join(m.secretsPath, container)
+}
+
+// secretsStagingDir is the directory on a tmpfs where the secrets are
+// copied when the container starts, and that is mounted in the
+// container.
+func secretsStagingDir(runDirectory, container string) string {
+	return filepath.Join(runDirectory, "os-container-secrets", container)
+}
+
+func writeSecretFile(dir, name string, data []byte) error {
+	tmp, err := ioutil.TempFile(dir, ".secret-")
+	if err != nil {
+		return errors.Wrapf(err, "create temporary file in %s", dir)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "write the secret %s", name)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "write the secret %s", name)
+	}
+	/* Renamed, so that a running container never sees a partial file.  */
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return errors.Wrapf(err, "write the secret %s", name)
+	}
+	return nil
+}
+
+// storeSecrets copies the secrets, given as name to file, in the
+// secrets store of the container that only the owner can read.
+func (m *Manager) storeSecrets(container string, secrets map[string]string) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(m.secretsPath, 0700); err != nil {
+		return errors.Wrapf(err, "create %s", m.secretsPath)
+	}
+	dir := m.secretsDir(container)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "create %s", dir)
+	}
+	for name, file := range secrets {
+		if !secretNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid secret name %q", name)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "read the secret %s", name)
+		}
+		if err := writeSecretFile(dir, name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The secrets of the previous deployment of a container, and the copy
+// of the store kept while an update changes it.
+func (m *Manager) previousSecretsDir(container string) string {
+	return filepath.Join(m.secretsPath, ".previous", container)
+}
+
+func (m *Manager) updateSecretsDir(container string) string {
+	return filepath.Join(m.secretsPath, ".update", container)
+}
+
+// snapshotSecrets copies the secrets store of a container aside before
+// an update changes it.
+func (m *Manager) snapshotSecrets(container string) error {
+	snapshot := m.updateSecretsDir(container)
+	if err := os.RemoveAll(snapshot); err != nil {
+		return errors.Wrapf(err, "delete %s", snapshot)
+	}
+	names, err := m.secretNames(container)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(snapshot, 0700); err != nil {
+		return errors.Wrapf(err, "create %s", snapshot)
+	}
+	for _, s := range names {
+		data, err := ioutil.ReadFile(filepath.Join(m.secretsDir(container), s))
+		if err != nil {
+			return errors.Wrapf(err, "read the secret %s", s)
+		}
+		if err := writeSecretFile(snapshot, s, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSecrets puts back the secrets store of a container saved by
+// snapshotSecrets, after a failed update.
+func (m *Manager) restoreSecrets(container string) error {
+	store := m.secretsDir(container)
+	snapshot := m.updateSecretsDir(container)
+	if _, err := os.Stat(snapshot); err != nil {
+		return nil
+	}
+	if err := os.RemoveAll(store); err != nil {
+		return errors.Wrapf(err, "delete %s", store)
+	}
+	if err := os.Rename(snapshot, store); err != nil {
+		return errors.Wrapf(err, "restore the secrets of %s", container)
+	}
+	return nil
+}
+
+// keepPreviousSecrets keeps the snapshot of the store as the secrets of
+// the previous deployment, once an update succeeded.
+func (m *Manager) keepPreviousSecrets(container string) error {
+	snapshot := m.updateSecretsDir(container)
+	previous := m.previousSecretsDir(container)
+	if err := os.RemoveAll(previous); err != nil {
+		return errors.Wrapf(err, "delete %s", previous)
+	}
+	if _, err := os.Stat(snapshot); err != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(previous), 0700); err != nil {
+		return errors.Wrapf(err, "create %s", filepath.Dir(previous))
+	}
+	if err := os.Rename(snapshot, previous); err != nil {
+		return errors.Wrapf(err, "keep the previous secrets of %s", container)
+	}
+	return nil
+}
+
+// swapSecrets exchanges the secrets store of a container with the
+// secrets of the previous deployment, on a rollback.  Deployments
+// created before the previous secrets were kept share the store.
+func (m *Manager) swapSecrets(container string) error {
+	store := m.secretsDir(container)
+	previous := m.previousSecretsDir(container)
+	tmp := m.updateSecretsDir(container)
+	if _, err := os.Stat(previous); err != nil {
+		return nil
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return errors.Wrapf(err, "delete %s", tmp)
+	}
+	if err := os.MkdirAll(filepath.Dir(tmp), 0700); err != nil {
+		return errors.Wrapf(err, "create %s", filepath.Dir(tmp))
+	}
+	if err := os.MkdirAll(store, 0700); err != nil {
+		return errors.Wrapf(err, "create %s", store)
+	}
+	if err := os.Rename(store, tmp); err != nil {
+		return errors.Wrapf(err, "swap the secrets of %s", container)
+	}
+	if err := os.Rename(previous, store); err != nil {
+		return errors.Wrapf(err, "swap the secrets of %s", container)
+	}
+	if err := os.Rename(tmp, previous); err != nil {
+		return errors.Wrapf(err, "swap the secrets of %s", container)
+	}
+	return nil
+}
+
+func (m *Manager) secretNames(container string) ([]string, error) {
+	files, err := ioutil.ReadDir(m.secretsDir(container))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read the secrets of %s", container)
+	}
+	var ret []string
+	for _, f := range files {
+		if secretNameRegex.MatchString(f.Name()) {
+			ret = append(ret, f.Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// setupSecrets checks that the secrets required by the image are in
+// the store, then mounts the staging directory in the container and
+// writes in the deployment the drop-in of the service that copies the
+// secrets there before it starts.
+func (m *Manager) setupSecrets(container, configFile string, required []string, mountLabel string, values map[string]string) ([]string, error) {
+	names, err := m.secretNames(container)
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[string]bool)
+	for _, n := range names {
+		available[n] = true
+	}
+	for _, r := range required {
+		if !available[r] {
+			return nil, fmt.Errorf("the image requires the secret %s, specify it with --secret %s=FILE", r, r)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	staging := secretsStagingDir(values["RUN_DIRECTORY"], container)
+	err = modifyOCIConfig(configFile, func(g *generate.Generator) error {
+		g.RemoveMount(secretsMountPoint)
+		g.AddMount(rspec.Mount{
+			Destination: secretsMountPoint,
+			Type:        "bind",
+			Source:      staging,
+			Options:     []string{"rbind", "ro"},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	/* The previous content is dropped, so that a deleted secret is not
+	   left behind.  */
+	store := m.stripRoot(m.secretsDir(container))
+	prestart := fmt.Sprintf("rm -rf '%s' && mkdir -p -m 0700 '%s' && cp -p '%s'/* '%s'/", staging, staging, store, staging)
+	if mountLabel != "" {
+		prestart = fmt.Sprintf("%s && chcon -R '%s' '%s'", prestart, mountLabel, staging)
+	}
+	dropIn := filepath.Join(filepath.Dir(configFile), secretsDropIn)
+	content := fmt.Sprintf("[Service]\nExecStartPre=/bin/sh -c \"%s\"\n", prestart)
+	if err := ioutil.WriteFile(dropIn, []byte(content), 0644); err != nil {
+		return nil, errors.Wrapf(err, "write %s", dropIn)
+	}
+	return names, nil
+}
+
+// installSecretsDropIn installs the drop-in of the deployment in
+// destDir, if it has secrets, so that it works with any service
+// template.
+func (m *Manager) installSecretsDropIn(name, destDir string) error {
+	src := filepath.Join(destDir, secretsDropIn)
+	if _, err := os.Stat(src); err != nil {
+		return nil
+	}
+	dest := filepath.Join(m.unitsPath, fmt.Sprintf("%s.service.d", name), secretsDropIn)
+	if err := copyFile(src, dest); err != nil {
+		return errors.Wrapf(err, "install %s", dest)
+	}
+	return nil
+}
+
+func (m *Manager) removeSecretsDropIn(name string) {
+	dropInDir := filepath.Join(m.unitsPath, fmt.Sprintf("%s.service.d", name))
+	os.Remove(filepath.Join(dropInDir, secretsDropIn))
+	os.Remove(dropInDir)
+}
+
+// UpdateSecrets replaces the secrets of a container, given as name to
+// file.  The secrets of a running container are replaced in place, so
+// a restart is not needed if the service reads them again.
+func (m *Manager) UpdateSecrets(name string, secrets map[string]string) error {
+	ctr, err := ReadContainer(m.checkoutsPath, name, nil)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, s := range ctr.Secrets {
+		known[s] = true
+	}
+	for s := range secrets {
+		if !known[s] {
+			return fmt.Errorf("the container %s has no secret %s, add it with update --secret", name, s)
+		}
+	}
+	if err := m.storeSecrets(name, secrets); err != nil {
+		return err
+	}
+
+	staging := m.underRoot(secretsStagingDir(fmt.Sprintf("%v", ctr.Values["RUN_DIRECTORY"]), name))
+	if _, err := os.Stat(staging); err != nil {
+		return nil
+	}
+	for s := range secrets {
+		data, err := ioutil.ReadFile(filepath.Join(m.secretsDir(name), s))
+		if err != nil {
+			return errors.Wrapf(err, "read the secret %s", s)
+		}
+		if err := writeSecretFile(staging, s, data); err != nil {
+			return err
+		}
+	}
+	m.logger.Printf("updated the secrets of the running container %s\n", name)
+	return nil
+}
+
+func (m *Manager) deleteSecrets(ctr *Container) error {
+	if runDirectory, ok := ctr.Values["RUN_DIRECTORY"]; ok {
+		os.RemoveAll(m.underRoot(secretsStagingDir(fmt.Sprintf("%v", runDirectory), ctr.Name)))
+	}
+	for _, dir := range []string{m.secretsDir(ctr.Name), m.previousSecretsDir(ctr.Name), m.updateSecretsDir(ctr.Name)} {
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrapf(err, "delete the secrets of %s", ctr.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package oscontainers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/opencontainers/runtime-tools/generate/seccomp"
+	"github.com/pkg/errors"
+)
+
+const (
+	labelSecurityOpt    = "label="
+	seccompSecurityOpt  = "seccomp="
+	apparmorSecurityOpt = "apparmor="
+
+	/* Disables the seccomp or the AppArmor profile.  */
+	unconfinedProfile = "unconfined"
+
+	apparmorProfilesDir = "/etc/apparmor.d"
+)
+
+var apparmorProfileRegex = regexp.MustCompile(`(?m)^\s*profile\s+([^\s{]+)`)
+
+// securityOptions are the parsed security options of a container.
+type securityOptions struct {
+	// Label are the SELinux options.
+	Label []string
+	// Seccomp is the path to a seccomp profile or unconfined.
+	Seccomp string
+	// AppArmor is the name of a loaded AppArmor profile or
+	// unconfined.
+	AppArmor string
+}
+
+// parseSecurityOpts parses the security options in the label=OPTION,
+// seccomp=FILE and apparmor=PROFILE forms.
+func parseSecurityOpts(opts []string) (*securityOptions, error) {
+	ret := &securityOptions{}
+	for _, o := range opts {
+		switch {
+		case strings.HasPrefix(o, labelSecurityOpt):
+			ret.Label = append(ret.Label, strings.TrimPrefix(o, labelSecurityOpt))
+		case strings.HasPrefix(o, seccompSecurityOpt):
+			ret.Seccomp = strings.TrimPrefix(o, seccompSecurityOpt)
+			if ret.Seccomp != unconfinedProfile && !filepath.IsAbs(ret.Seccomp) {
+				return nil, fmt.Errorf("the seccomp profile %s must be an absolute path", ret.Seccomp)
+			}
+		case strings.HasPrefix(o, apparmorSecurityOpt):
+			ret.AppArmor = strings.TrimPrefix(o, apparmorSecurityOpt)
+			if ret.AppArmor == "" {
+				return nil, fmt.Errorf("invalid security option %s", o)
+			}
+		default:
+			return nil, fmt.Errorf("invalid security option %s", o)
+		}
+	}
+	return ret, nil
+}
+
+func securityOptKind(o string) string {
+	return strings.SplitN(o, "=", 2)[0]
+}
+
+// mergeSecurityOpts replaces the options in previous with the ones of
+// the same kind in opts.
+func mergeSecurityOpts(previous, opts []string) []string {
+	replaced := make(map[string]bool)
+	for _, o := range opts {
+		replaced[securityOptKind(o)] = true
+	}
+	var ret []string
+	for _, o := range previous {
+		if !replaced[securityOptKind(o)] {
+			ret = append(ret, o)
+		}
+	}
+	return append(ret, opts...)
+}
+
+func validateSeccompAction(action rspec.LinuxSeccompAction) error {
+	switch action {
+	case rspec.ActKill, rspec.ActTrap, rspec.ActErrno, rspec.ActTrace, rspec.ActAllow:
+		return nil
+	}
+	return fmt.Errorf("invalid seccomp action %q", action)
+}
+
+// readSeccompProfile reads a seccomp profile in the format of the
+// linux.seccomp field of the OCI configuration.
+func readSeccompProfile(path string) (*rspec.LinuxSeccomp, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read the seccomp profile %s", path)
+	}
+	var profile rspec.LinuxSeccomp
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, errors.Wrapf(err, "parse the seccomp profile %s", path)
+	}
+	if err := validateSeccompAction(profile.DefaultAction); err != nil {
+		return nil, errors.Wrapf(err, "invalid seccomp profile %s", path)
+	}
+	for _, s := range profile.Syscalls {
+		if len(s.Names) == 0 {
+			return nil, fmt.Errorf("invalid seccomp profile %s: a rule has no syscall names", path)
+		}
+		if err := validateSeccompAction(s.Action); err != nil {
+			return nil, errors.Wrapf(err, "invalid seccomp profile %s", path)
+		}
+	}
+	return &profile, nil
+}
+
+// seccompProfile returns the seccomp profile for a deployment: the one
+// of the administrator, then the one shipped by the image in
+// exports/seccomp.json or in the configuration template, and the
+// default profile for the capabilities of the container otherwise.
+func seccompProfile(opts *securityOptions, rootfs string, spec *rspec.Spec) (*rspec.LinuxSeccomp, error) {
+	if opts.Seccomp == unconfinedProfile {
+		return nil, nil
+	}
+	if opts.Seccomp != "" {
+		return readSeccompProfile(opts.Seccomp)
+	}
+	imageProfile := filepath.Join(rootfs, "exports/seccomp.json")
+	if _, err := os.Stat(imageProfile); err == nil {
+		return readSeccompProfile(imageProfile)
+	}
+	if spec.Linux != nil && spec.Linux.Seccomp != nil {
+		return spec.Linux.Seccomp, nil
+	}
+
+	/* The default profile allows the syscalls needed by the
+	   capabilities of the process.  */
+	withCapabilities := *spec
+	if spec.Process == nil || spec.Process.Capabilities == nil {
+		process := rspec.Process{Capabilities: &rspec.LinuxCapabilities{}}
+		if spec.Process != nil {
+			process = *spec.Process
+			process.Capabilities = &rspec.LinuxCapabilities{}
+		}
+		withCapabilities.Process = &process
+	}
+	return seccomp.DefaultProfile(&withCapabilities), nil
+}
+
+func apparmorEnabled() bool {
+	data, err := ioutil.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.HasPrefix(string(data), "Y")
+}
+
+func apparmorProfileLoaded(name string) (bool, error) {
+	data, err := ioutil.ReadFile("/sys/kernel/security/apparmor/profiles")
+	if err != nil {
+		return false, errors.Wrapf(err, "read the AppArmor profiles")
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(l, name+" (") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *Manager) apparmorProfileFile(container string) string {
+	return filepath.Join(m.apparmorPath, fmt.Sprintf("os-container-%s", container))
+}
+
+// loadAppArmorProfile installs the AppArmor profile shipped by the image
+// in exports/apparmor.profile and loads it in the kernel.  It returns
+// the name of the profile, which must be os-container-NAME so that the
+// image cannot replace the profile of another program.
+func (m *Manager) loadAppArmorProfile(container, rootfs string) (string, error) {
+	src := filepath.Join(rootfs, "exports/apparmor.profile")
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "read %s", src)
+	}
+	if !apparmorEnabled() || m.rootless {
+		m.logger.Printf("AppArmor is not available, the profile of the image is not loaded\n")
+		return "", nil
+	}
+	match := apparmorProfileRegex.FindSubmatch(data)
+	if match == nil {
+		return "", fmt.Errorf("cannot find the name of the AppArmor profile in %s", src)
+	}
+	dest := m.apparmorProfileFile(container)
+	if name := string(match[1]); name != filepath.Base(dest) {
+		return "", fmt.Errorf("the AppArmor profile of the image is %s, it must be %s", name, filepath.Base(dest))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", errors.Wrapf(err, "create %s", filepath.Dir(dest))
+	}
+	if err := ioutil.WriteFile(dest, data, 0644); err != nil {
+		return "", errors.Wrapf(err, "write %s", dest)
+	}
+
+	/* In an alternate root, the profile is only checked and it is
+	   loaded on the next boot.  */
+	args := []string{"-r", "-W", dest}
+	if m.root != "" {
+		args = []string{"-Q", "-K", dest}
+	}
+	if out, err := exec.Command("apparmor_parser", args...).CombinedOutput(); err != nil {
+		os.Remove(dest)
+		return "", errors.Wrapf(err, "load the AppArmor profile %s: %s", src, strings.TrimSpace(string(out)))
+	}
+	return filepath.Base(dest), nil
+}
+
+// unloadAppArmorProfile unloads and deletes the AppArmor profile
+// installed for a container, if any.
+func (m *Manager) unloadAppArmorProfile(container string) {
+	file := m.apparmorProfileFile(container)
+	if _, err := os.Stat(file); err != nil {
+		return
+	}
+	if m.root == "" {
+		if out, err := exec.Command("apparmor_parser", "-R", file).CombinedOutput(); err != nil {
+			m.logger.Printf("could not unload the AppArmor profile %s: %s\n", file, strings.TrimSpace(string(out)))
+		}
+	}
+	os.Remove(file)
+}
+
+// apparmorProfile returns the AppArmor profile for a deployment: the
+// one of the administrator, which must be already loaded, or the one
+// shipped by the image.
+func (m *Manager) apparmorProfile(opts *securityOptions, container, rootfs string) (string, error) {
+	switch opts.AppArmor {
+	case "":
+		return m.loadAppArmorProfile(container, rootfs)
+	case unconfinedProfile:
+		return "", nil
+	}
+	if !apparmorEnabled() {
+		return "", fmt.Errorf("cannot use the AppArmor profile %s, AppArmor is not enabled", opts.AppArmor)
+	}
+	loaded, err := apparmorProfileLoaded(opts.AppArmor)
+	if err != nil {
+		return "", err
+	}
+	if !loaded {
+		return "", fmt.Errorf("the AppArmor profile %s is not loaded", opts.AppArmor)
+	}
+	return opts.AppArmor, nil
+}
+
+// applySecurityProfiles sets the seccomp and the AppArmor profiles in
+// the OCI configuration of a deployment.
+func (m *Manager) applySecurityProfiles(opts *securityOptions, container, rootfs, configFile string) error {
+	return modifyOCIConfig(configFile, func(g *generate.Generator) error {
+		spec := g.Spec()
+		profile, err := seccompProfile(opts, rootfs, spec)
+		if err != nil {
+			return err
+		}
+		if spec.Linux == nil {
+			spec.Linux = &rspec.Linux{}
+		}
+		spec.Linux.Seccomp = profile
+
+		apparmor, err := m.apparmorProfile(opts, container, rootfs)
+		if err != nil {
+			return err
+		}
+		/* Keep the profile of the configuration template, if any.  */
+		if apparmor != "" || opts.AppArmor == unconfinedProfile {
+			g.SetProcessApparmorProfile(apparmor)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,76 @@
+package oscontainers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func (m *Manager) readServiceContainer(name string) (*Container, error) {
+	if m.root != "" {
+		return nil, fmt.Errorf("containers cannot be started or stopped in an alternate root")
+	}
+	c, err := ReadContainer(m.checkoutsPath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !c.HasContainerService {
+		return nil, fmt.Errorf("the container %s has no service", name)
+	}
+	return c, nil
+}
+
+func (m *Manager) serviceCommand(cmd, name string) error {
+	c, err := m.readServiceContainer(name)
+	if err != nil {
+		return err
+	}
+	if out, err := m.systemctlCommand(cmd, c.Name, false, false); err != nil {
+		return errors.Wrapf(err, "cannot %s %s: %s", cmd, c.Name, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (m *Manager) Start(name string) error {
+	return m.serviceCommand("start", name)
+}
+
+func (m *Manager) Stop(name string) error {
+	return m.serviceCommand("stop", name)
+}
+
+func (m *Manager) Restart(name string) error {
+	return m.serviceCommand("restart", name)
+}
+
+// WaitActive waits until the service of the container is active.  It
+// fails if the service fails or the timeout expires first.
+func (m *Manager) WaitActive(name string, timeout time.Duration) error {
+	c, err := m.readServiceContainer(name)
+	if err != nil {
+		return err
+	}
+	deadline := time.After(timeout)
+	for {
+		status, err := m.ContainerStatus(c)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case Running:
+			return nil
+		case Failed:
+			return fmt.Errorf("the container %s failed to start", name)
+		}
+
+		select {
+		case <-m.ctx.Done():
+			return m.ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("timeout waiting for the container %s to be active", name)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package oscontainers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/transports/alltransports"
+	"github.com/pkg/errors"
+)
+
+const systemRegistriesConfFile = "/etc/containers/registries.conf"
+
+/* Both the v1 and the v2 format of registries.conf are accepted.  */
+type registriesConf struct {
+	UnqualifiedSearch []string `toml:"unqualified-search-registries"`
+	Registries        struct {
+		Search struct {
+			Registries []string `toml:"registries"`
+		} `toml:"search"`
+	} `toml:"registries"`
+	Aliases map[string]string `toml:"aliases"`
+}
+
+func getRegistriesConfFile(rootless bool, configHome string) string {
+	if rootless {
+		userFile := filepath.Join(configHome, "containers/registries.conf")
+		if _, err := os.Stat(userFile); err == nil {
+			return userFile
+		}
+	}
+	return systemRegistriesConfFile
+}
+
+func readRegistriesConf(path string) (*registriesConf, error) {
+	var conf registriesConf
+	if _, err := toml.DecodeFile(path, &conf); err != nil {
+		if os.IsNotExist(err) {
+			return &conf, nil
+		}
+		return nil, errors.Wrapf(err, "read %s", path)
+	}
+	return &conf, nil
+}
+
+func (c *registriesConf) searchRegistries() []string {
+	if len(c.UnqualifiedSearch) > 0 {
+		return c.UnqualifiedSearch
+	}
+	return c.Registries.Search.Registries
+}
+
+// isShortName tells whether image is a name without a registry, such
+// as "etcd" or "coreos/etcd:v3".
+func isShortName(image string) bool {
+	if _, err := alltransports.ParseImageName(image); err == nil {
+		return false
+	}
+	i := strings.IndexRune(image, '/')
+	if i < 0 {
+		return true
+	}
+	domain := image[:i]
+	return !strings.ContainsAny(domain, ".:") && domain != "localhost"
+}
+
+// splitShortName splits an image name in the repository and the
+// ":tag" or "@digest" suffix, the tag defaults to latest.
+func splitShortName(image string) (string, string) {
+	if i := strings.Index(image, "@"); i > 0 {
+		return image[:i], image[i:]
+	}
+	if i := strings.LastIndex(image, ":"); i > 0 {
+		return image[:i], image[i:]
+	}
+	return image, ":latest"
+}
+
+func (m *Manager) findLocalImages(image string) ([]string, error) {
+	if _, err := os.Stat(m.repoPath); err != nil {
+		return nil, nil
+	}
+	repo, err := openRepo(m.repoPath)
+	if err != nil {
+		return nil, err
+	}
+	images, err := getImages(repo, false)
+	if err != nil {
+		return nil, err
+	}
+
+	path, suffix := splitShortName(image)
+	if !strings.HasPrefix(suffix, ":") {
+		return nil, nil
+	}
+	tag := suffix[1:]
+	var ret []string
+	for _, i := range images {
+		named, err := reference.ParseNormalizedNamed(i.Name)
+		if err != nil {
+			continue
+		}
+		tagged, ok := named.(reference.Tagged)
+		if !ok || tagged.Tag() != tag {
+			continue
+		}
+		p := reference.Path(named)
+		if p == path || strings.HasSuffix(p, "/"+path) {
+			ret = append(ret, named.String())
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// resolveImageName returns the fully qualified name for a short image
+// name.  The images already pulled are looked up first, then the
+// aliases and the search registries of registries.conf.  registry,
+// when specified, is used instead of the search.
+func (m *Manager) resolveImageName(image string) (string, error) {
+	if image == "" || !isShortName(image) {
+		return image, nil
+	}
+	if m.registry != "" {
+		return fmt.Sprintf("%s/%s", m.registry, image), nil
+	}
+
+	local, err := m.findLocalImages(image)
+	if err != nil {
+		return "", err
+	}
+	if len(local) == 1 {
+		return local[0], nil
+	}
+	if len(local) > 1 {
+		return "", fmt.Errorf("the short name %s matches multiple local images: %s, use --registry or the full name", image, strings.Join(local, ", "))
+	}
+
+	conf, err := readRegistriesConf(m.registriesConf)
+	if err != nil {
+		return "", err
+	}
+	path, suffix := splitShortName(image)
+	if alias, ok := conf.Aliases[path]; ok {
+		return alias + suffix, nil
+	}
+
+	search := conf.searchRegistries()
+	switch len(search) {
+	case 0:
+		return image, nil
+	case 1:
+		return fmt.Sprintf("%s/%s", search[0], image), nil
+	}
+	var candidates []string
+	for _, r := range search {
+		candidates = append(candidates, fmt.Sprintf("%s/%s", r, image))
+	}
+	return "", fmt.Errorf("the short name %s is ambiguous, candidates: %s, use --registry or the full name", image, strings.Join(candidates, ", "))
+}
@@ -0,0 +1,205 @@
+package oscontainers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	selinux "github.com/opencontainers/selinux/go-selinux"
+	"github.com/pkg/errors"
+)
+
+type VolumeInfo struct {
+	Name string
+	// Path is where the volume is mounted in the container, it is
+	// empty for a volume not used anymore by the active deployment.
+	Path   string
+	Source string
+	Size   uint64
+}
+
+func validateVolume(v *ContainerVolume) error {
+	if v.Name == "" || strings.Contains(v.Name, "/") || v.Name == "." || v.Name == ".." {
+		return fmt.Errorf("invalid volume name %q", v.Name)
+	}
+	if !filepath.IsAbs(v.Path) {
+		return fmt.Errorf("the path of the volume %s must be absolute", v.Name)
+	}
+	return nil
+}
+
+func parseVolumeOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid owner %s", owner)
+	}
+	gid := uid
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid owner %s", owner)
+		}
+	}
+	return uid, gid, nil
+}
+
+func (m *Manager) volumeSource(container, volume string) string {
+	return filepath.Join(m.volumesPath, container, volume)
+}
+
+// createVolume creates the directory of a volume with its owner, mode
+// and SELinux type.  An existing volume is not modified, so that its
+// data is kept across updates and rollbacks.
+func (m *Manager) createVolume(container string, v *ContainerVolume) error {
+	if err := validateVolume(v); err != nil {
+		return err
+	}
+	source := m.volumeSource(container, v.Name)
+	if _, err := os.Stat(source); err == nil {
+		return nil
+	}
+
+	mode := os.FileMode(0755)
+	if v.Mode != "" {
+		parsed, err := strconv.ParseUint(v.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %s for the volume %s", v.Mode, v.Name)
+		}
+		mode = os.FileMode(parsed)
+	}
+	if err := os.MkdirAll(filepath.Dir(source), 0700); err != nil {
+		return errors.Wrapf(err, "create %s", filepath.Dir(source))
+	}
+	if err := os.Mkdir(source, mode); err != nil {
+		return errors.Wrapf(err, "create the volume %s", v.Name)
+	}
+	if err := os.Chmod(source, mode); err != nil {
+		return errors.Wrapf(err, "chmod %s", source)
+	}
+
+	if v.Owner != "" {
+		uid, gid, err := parseVolumeOwner(v.Owner)
+		if err != nil {
+			return err
+		}
+		/* The rootless user is root in the container.  */
+		if m.rootless && (uid != 0 || gid != 0) {
+			m.logger.Printf("cannot set the owner %s of the volume %s for a rootless container\n", v.Owner, v.Name)
+		} else if !m.rootless {
+			if err := os.Chown(source, uid, gid); err != nil {
+				return errors.Wrapf(err, "chown %s", source)
+			}
+		}
+	}
+
+	if v.SELinuxType != "" && selinux.GetEnabled() {
+		label, err := selinux.FileLabel(source)
+		if err != nil {
+			return errors.Wrapf(err, "read the label of %s", source)
+		}
+		ctx := selinux.NewContext(label)
+		ctx["type"] = v.SELinuxType
+		if err := selinux.SetFileLabel(source, ctx.Get()); err != nil {
+			return errors.Wrapf(err, "set the label of %s", source)
+		}
+	}
+	m.logger.Printf("created the volume %s\n", source)
+	return nil
+}
+
+// modifyOCIConfig applies fn to the OCI configuration in configFile.
+func modifyOCIConfig(configFile string, fn func(g *generate.Generator) error) error {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open file %s", configFile)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return errors.Wrapf(err, "unmarshal container %s conf file", configFile)
+	}
+	g := generate.NewFromSpec(&spec)
+	if err := fn(&g); err != nil {
+		return err
+	}
+	return g.SaveToFile(configFile, generate.ExportOptions{})
+}
+
+// addVolumeMounts creates the volumes of a container and bind mounts
+// them in its OCI configuration.
+func (m *Manager) addVolumeMounts(container, configFile string, volumes []ContainerVolume) error {
+	if len(volumes) == 0 {
+		return nil
+	}
+	return modifyOCIConfig(configFile, func(g *generate.Generator) error {
+		for i := range volumes {
+			v := &volumes[i]
+			if err := m.createVolume(container, v); err != nil {
+				return err
+			}
+			g.RemoveMount(v.Path)
+			g.AddMount(rspec.Mount{
+				Destination: v.Path,
+				Type:        "bind",
+				Source:      m.stripRoot(m.volumeSource(container, v.Name)),
+				Options:     []string{"rbind", "rw"},
+			})
+		}
+		return nil
+	})
+}
+
+// Volumes lists the volumes of a container, including the ones that the
+// active deployment doesn't use anymore.
+func (m *Manager) Volumes(name string) ([]VolumeInfo, error) {
+	ctr, err := ReadContainer(m.checkoutsPath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]string)
+	for _, v := range ctr.Volumes {
+		paths[v.Name] = v.Path
+	}
+
+	dirs, err := ioutil.ReadDir(filepath.Join(m.volumesPath, name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "read the volumes of %s", name)
+	}
+	ret := []VolumeInfo{}
+	for _, d := range dirs {
+		source := m.volumeSource(name, d.Name())
+		size, _, err := directorySize(source, make(map[inodeKey]bool))
+		if err != nil {
+			return nil, errors.Wrapf(err, "compute the size of %s", source)
+		}
+		ret = append(ret, VolumeInfo{
+			Name:   d.Name(),
+			Path:   paths[d.Name()],
+			Source: source,
+			Size:   size,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+func (m *Manager) deleteVolumes(name string) error {
+	dir := filepath.Join(m.volumesPath, name)
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrapf(err, "delete the volumes of %s", name)
+	}
+	m.logger.Printf("deleted the volumes %s\n", dir)
+	return nil
+}
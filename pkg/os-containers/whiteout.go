@@ -0,0 +1,160 @@
+package oscontainers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+/* As defined by the OCI image specification.  */
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// layerWhiteouts lists the whiteouts of a layer, all the paths are
+// relative to the root of the layer.
+type layerWhiteouts struct {
+	// Opaque are the directories whose content in the lower layers
+	// is hidden.
+	Opaque []string
+	// Removed are the paths deleted from the lower layers.
+	Removed []string
+	// Markers are the whiteout files themselves.
+	Markers []string
+}
+
+// add records the entry rel of a layer when it is a whiteout, and
+// tells whether it is.
+func (w *layerWhiteouts) add(rel string) bool {
+	name := filepath.Base(rel)
+	if !strings.HasPrefix(name, whiteoutPrefix) {
+		return false
+	}
+	dir := filepath.Dir(rel)
+	if name == whiteoutOpaque {
+		w.Opaque = append(w.Opaque, dir)
+	} else {
+		w.Removed = append(w.Removed, filepath.Join(dir, strings.TrimPrefix(name, whiteoutPrefix)))
+	}
+	w.Markers = append(w.Markers, rel)
+	return true
+}
+
+func readWhiteouts(root string) (*layerWhiteouts, error) {
+	ret := &layerWhiteouts{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if ret.add(rel) && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "read the whiteouts in %s", root)
+	}
+	return ret, nil
+}
+
+// hasSymlinkParent tells whether one of the parents of rel under root
+// is a symlink, that could point outside of root.
+func hasSymlinkParent(root, rel string) bool {
+	parent := root
+	parts := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+	for _, p := range parts {
+		if p == "." || p == "" {
+			continue
+		}
+		parent = filepath.Join(parent, p)
+		st, err := os.Lstat(parent)
+		if err != nil || st.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// applyWhiteouts deletes from the rootfs being assembled what the
+// whiteouts of the next layer hide.  It must be done before the layer
+// is checked out, as the content of an opaque directory in the same
+// layer is kept.
+func applyWhiteouts(rootfs string, w *layerWhiteouts) error {
+	for _, d := range w.Opaque {
+		if hasSymlinkParent(rootfs, filepath.Join(d, "x")) {
+			continue
+		}
+		dir := filepath.Join(rootfs, d)
+		st, err := os.Lstat(dir)
+		if err != nil || !st.IsDir() {
+			continue
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return errors.Wrapf(err, "read %s", dir)
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return errors.Wrapf(err, "delete %s", filepath.Join(d, e.Name()))
+			}
+		}
+	}
+	for _, p := range w.Removed {
+		if hasSymlinkParent(rootfs, p) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(rootfs, p)); err != nil {
+			return errors.Wrapf(err, "delete %s", p)
+		}
+	}
+	return nil
+}
+
+func removeWhiteoutMarkers(rootfs string, w *layerWhiteouts) error {
+	for _, p := range w.Markers {
+		if hasSymlinkParent(rootfs, p) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(rootfs, p)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "delete %s", p)
+		}
+	}
+	return nil
+}
+
+// convertWhiteoutsToOverlay replaces the whiteouts of a layer with the
+// overlayfs ones: a 0/0 character device for a deleted file and the
+// trusted.overlay.opaque attribute for an opaque directory.
+func convertWhiteoutsToOverlay(root string, w *layerWhiteouts) error {
+	if err := removeWhiteoutMarkers(root, w); err != nil {
+		return err
+	}
+	for _, d := range w.Opaque {
+		if hasSymlinkParent(root, filepath.Join(d, "x")) {
+			continue
+		}
+		dir := filepath.Join(root, d)
+		if err := syscall.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+			return errors.Wrapf(err, "set the opaque attribute on %s", d)
+		}
+	}
+	for _, p := range w.Removed {
+		if hasSymlinkParent(root, p) {
+			continue
+		}
+		path := filepath.Join(root, p)
+		if err := syscall.Mknod(path, syscall.S_IFCHR, 0); err != nil {
+			return errors.Wrapf(err, "create the whiteout %s", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package oscontainers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// writeTree creates the entries of a fixture layer in root: "path/" is
+// a directory, "path -> target" a symlink and anything else a file.
+// "@outside" in a symlink target is replaced with outside.
+func writeTree(t *testing.T, root, outside string, entries []string) {
+	for _, e := range entries {
+		switch {
+		case strings.Contains(e, " -> "):
+			parts := strings.SplitN(e, " -> ", 2)
+			path := filepath.Join(root, parts[0])
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(strings.Replace(parts[1], "@outside", outside, 1), path); err != nil {
+				t.Fatal(err)
+			}
+		case strings.HasSuffix(e, "/"):
+			if err := os.MkdirAll(filepath.Join(root, e), 0755); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			path := filepath.Join(root, e)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(e), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// readTree lists root in the format of writeTree.
+func readTree(t *testing.T, root string) []string {
+	var ret []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, rel+" -> "+target)
+		case info.IsDir():
+			ret = append(ret, rel+"/")
+		default:
+			ret = append(ret, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// copyTree merges the layer src in dest, as a union checkout does.
+func copyTree(t *testing.T, src, dest string) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			return os.Symlink(link, target)
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assembleLayers builds a rootfs from fixture layers the way
+// checkoutLayers does.
+func assembleLayers(t *testing.T, dir string, layers [][]string) string {
+	rootfs := filepath.Join(dir, "rootfs")
+	for i, entries := range layers {
+		layer := filepath.Join(dir, "layers", strconv.Itoa(i))
+		writeTree(t, layer, "", entries)
+		whiteouts, err := readWhiteouts(layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			if err := applyWhiteouts(rootfs, whiteouts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		copyTree(t, layer, rootfs)
+		if err := removeWhiteoutMarkers(rootfs, whiteouts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootfs
+}
+
+func TestReadWhiteouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		layer   []string
+		opaque  []string
+		removed []string
+		markers []string
+	}{
+		{
+			name:  "no whiteouts",
+			layer: []string{"etc/a", "usr/bin/"},
+		},
+		{
+			name:    "deleted file",
+			layer:   []string{"etc/.wh.a", "etc/b"},
+			removed: []string{"etc/a"},
+			markers: []string{"etc/.wh.a"},
+		},
+		{
+			name:    "opaque directory",
+			layer:   []string{"d/.wh..wh..opq", "d/new"},
+			opaque:  []string{"d"},
+			markers: []string{"d/.wh..wh..opq"},
+		},
+		{
+			name:    "whiteout of a directory",
+			layer:   []string{".wh.dir", "keep"},
+			removed: []string{"dir"},
+			markers: []string{".wh.dir"},
+		},
+		{
+			name:    "marker that is a directory",
+			layer:   []string{".wh.dir/", ".wh.dir/.wh.inner"},
+			removed: []string{"dir"},
+			markers: []string{".wh.dir"},
+		},
+		{
+			name:    "several whiteouts",
+			layer:   []string{"a/.wh..wh..opq", "a/b/.wh.c", "d/.wh.e", "d/f"},
+			opaque:  []string{"a"},
+			removed: []string{"a/b/c", "d/e"},
+			markers: []string{"a/.wh..wh..opq", "a/b/.wh.c", "d/.wh.e"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "whiteouts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			writeTree(t, dir, "", tt.layer)
+
+			w, err := readWhiteouts(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(w.Opaque, tt.opaque) {
+				t.Errorf("opaque: got %v, want %v", w.Opaque, tt.opaque)
+			}
+			if !reflect.DeepEqual(w.Removed, tt.removed) {
+				t.Errorf("removed: got %v, want %v", w.Removed, tt.removed)
+			}
+			if !reflect.DeepEqual(w.Markers, tt.markers) {
+				t.Errorf("markers: got %v, want %v", w.Markers, tt.markers)
+			}
+		})
+	}
+}
+
+func TestAssembleLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]string
+		want   []string
+	}{
+		{
+			name: "deleted file",
+			layers: [][]string{
+				{"etc/a", "etc/b"},
+				{"etc/.wh.a"},
+			},
+			want: []string{"etc/", "etc/b"},
+		},
+		{
+			name: "opaque directory",
+			layers: [][]string{
+				{"d/old", "d/sub/x", "other"},
+				{"d/.wh..wh..opq", "d/new"},
+			},
+			want: []string{"d/", "d/new", "other"},
+		},
+		{
+			name: "whiteout of a directory",
+			layers: [][]string{
+				{"dir/sub/x", "keep"},
+				{".wh.dir"},
+			},
+			want: []string{"keep"},
+		},
+		{
+			name: "recreated in an upper layer",
+			layers: [][]string{
+				{"a/x"},
+				{".wh.a"},
+				{"a/y"},
+			},
+			want: []string{"a/", "a/y"},
+		},
+		{
+			name: "whiteout in the first layer",
+			layers: [][]string{
+				{"etc/.wh.a", "etc/b"},
+				{"etc/c"},
+			},
+			want: []string{"etc/", "etc/b", "etc/c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "whiteouts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			rootfs := assembleLayers(t, dir, tt.layers)
+			if got := readTree(t, rootfs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhiteoutsUnderSymlink(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func(string, *layerWhiteouts) error
+	}{
+		{name: "applyWhiteouts", apply: applyWhiteouts},
+		{name: "removeWhiteoutMarkers", apply: removeWhiteoutMarkers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "whiteouts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			outside := filepath.Join(dir, "outside")
+			rootfs := filepath.Join(dir, "rootfs")
+			writeTree(t, outside, "", []string{"victim", ".wh.victim", "sub/x"})
+			writeTree(t, rootfs, outside, []string{"link -> @outside", "etc/a"})
+
+			w := &layerWhiteouts{
+				Opaque:  []string{"link", "link/sub"},
+				Removed: []string{"link/victim"},
+				Markers: []string{"link/.wh.victim"},
+			}
+			if err := tt.apply(rootfs, w); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{".wh.victim", "sub/", "sub/x", "victim"}
+			if got := readTree(t, outside); !reflect.DeepEqual(got, want) {
+				t.Errorf("outside: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestConvertWhiteoutsToOverlay(t *testing.T) {
+	probe, err := ioutil.TempDir("", "whiteouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(probe)
+	if err := syscall.Setxattr(probe, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("cannot set trusted xattrs: %v", err)
+	}
+	if err := syscall.Mknod(filepath.Join(probe, "dev"), syscall.S_IFCHR, 0); err != nil {
+		t.Skipf("cannot create device nodes: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		layer   []string
+		devices []string
+		opaque  []string
+		want    []string
+		// symlinked adds the whiteouts found under link before it
+		// was replaced with a symlink.
+		symlinked bool
+	}{
+		{
+			name:    "deleted file",
+			layer:   []string{"etc/.wh.a", "etc/b"},
+			devices: []string{"etc/a"},
+			want:    []string{"etc/", "etc/a", "etc/b"},
+		},
+		{
+			name:   "opaque directory",
+			layer:  []string{"d/.wh..wh..opq", "d/new"},
+			opaque: []string{"d"},
+			want:   []string{"d/", "d/new"},
+		},
+		{
+			name:    "whiteout of a directory",
+			layer:   []string{".wh.dir", "keep"},
+			devices: []string{"dir"},
+			want:    []string{"dir", "keep"},
+		},
+		{
+			name:      "marker under a symlinked parent",
+			layer:     []string{"link -> @outside"},
+			want:      []string{"link -> @outside"},
+			symlinked: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "whiteouts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			outside := filepath.Join(dir, "outside")
+			root := filepath.Join(dir, "layer")
+			writeTree(t, outside, "", []string{".wh.victim"})
+			writeTree(t, root, outside, tt.layer)
+
+			w, err := readWhiteouts(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.symlinked {
+				w.Removed = append(w.Removed, "link/victim")
+				w.Markers = append(w.Markers, "link/.wh.victim")
+				w.Opaque = append(w.Opaque, "link")
+			}
+			if err := convertWhiteoutsToOverlay(root, w); err != nil {
+				t.Fatal(err)
+			}
+
+			want := make([]string, len(tt.want))
+			for i, e := range tt.want {
+				want[i] = strings.Replace(e, "@outside", outside, 1)
+			}
+			if got := readTree(t, root); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got := readTree(t, outside); !reflect.DeepEqual(got, []string{".wh.victim"}) {
+				t.Errorf("outside: got %v", got)
+			}
+			for _, d := range tt.devices {
+				var st syscall.Stat_t
+				if err := syscall.Lstat(filepath.Join(root, d), &st); err != nil {
+					t.Fatal(err)
+				}
+				if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+					t.Errorf("%s is not a 0/0 character device", d)
+				}
+			}
+			for _, d := range tt.opaque {
+				value := make([]byte, 8)
+				n, err := syscall.Getxattr(filepath.Join(root, d), "trusted.overlay.opaque", value)
+				if err != nil || string(value[:n]) != "y" {
+					t.Errorf("%s is not opaque: %v", d, err)
+				}
+			}
+		})
+	}
+}